@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/publishers/backfill"
+	"github.com/yewno/acquisition/services"
+)
+
+// backfillBatch is how many deliveries are enqueued between records of
+// the progress.
+const backfillBatch = 100
+
+// backfillCommand processes the deliveries of a publisher again, directly
+// with -workers at a time or by enqueueing an S3 event for each on the new
+// content queue. It returns the exit status.
+//
+//	acquisition backfill --publisher oup --since 2016-01-01
+func backfillCommand(storage services.CobaltStorage, queue services.CobaltQueue, db *bolt.DB, args []string) int {
+
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	publisher := flags.String("publisher", "", "publisher to backfill, the directory under files/ it uploads to")
+	since := flags.String("since", "", "only deliveries uploaded on or after the date, as in 2016-01-01")
+	until := flags.String("until", "", "only deliveries uploaded before the date")
+	match := flags.String("match", "", "only deliveries whose key matches the regular expression")
+	enqueue := flags.Bool("enqueue", false, "send an S3 event for every delivery to the new content queue instead of processing it")
+	resend := flags.Bool("resend", false, "send the pairs of unchanged files again")
+	restart := flags.Bool("restart", false, "forget the progress of earlier backfills of the publisher and start over")
+	flags.Parse(args)
+
+	if *publisher == "" || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: acquisition [flags] backfill --publisher name [--since date] [--until date] [--match regexp] [--enqueue] [--resend] [--restart]")
+		return 2
+	}
+
+	filter := &backfill.Filter{}
+	var err error
+	if *since != "" {
+		if filter.Since, err = time.Parse("2006-01-02", *since); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = time.Parse("2006-01-02", *until); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+	if *match != "" {
+		if filter.Pattern, err = regexp.Compile(*match); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+
+	progress := backfill.NewProgress(db, *publisher)
+	if *restart {
+		if err := progress.Reset(); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	// deliveries split over several archives are processed once
+	processor, err := publishers.New(*publisher, &publishers.Env{Config: cfg, Stats: publishers.NewStats(), DB: db})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if grouper, ok := processor.(publishers.Grouper); ok {
+		filter.Delivery = grouper.Delivery
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	deliveries, err := backfill.Deliveries(ctx, storage, cfg.FtpBucket, *publisher, filter, progress)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("Backfilling %d deliveries of %s", len(deliveries), *publisher)
+
+	var status int
+	if *enqueue {
+		status = backfillEnqueue(ctx, queue, progress, deliveries)
+	} else {
+		status = backfillDirect(ctx, storage, queue, db, progress, *publisher, *resend, deliveries)
+	}
+
+	// the progress only carries an interrupted or failed backfill over,
+	// the next one after a complete run starts over with its own filter
+	if status == 0 {
+		if err := progress.Reset(); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	return status
+}
+
+// backfillEnqueue sends the S3 event of every delivery to the new content
+// queue.
+func backfillEnqueue(ctx context.Context, queue services.CobaltQueue, progress *backfill.Progress, deliveries []*services.Object) int {
+
+	for start := 0; start < len(deliveries); start += backfillBatch {
+		end := start + backfillBatch
+		if end > len(deliveries) {
+			end = len(deliveries)
+		}
+
+		batch := queue.NewBatch(ctx, cfg.NewContentQueue)
+		var sendErr error
+		for _, object := range deliveries[start:end] {
+			if err := batch.Add(publishers.NewDirectJob(object.Bucket, object.Key, object.Size).Message); err != nil {
+				log.Println(err)
+				sendErr = err
+			}
+		}
+		if err := batch.Flush(); err != nil {
+			// what was sent is sent again by the next backfill
+			log.Println(err)
+			return 1
+		}
+		if sendErr != nil {
+			return 1
+		}
+
+		for _, object := range deliveries[start:end] {
+			if err := progress.Mark(object.Key); err != nil {
+				log.Println(err)
+				return 1
+			}
+		}
+		log.Printf("Enqueued %d of %d", end, len(deliveries))
+	}
+	return 0
+}
+
+// backfillDirect processes the deliveries with -workers at a time. Failed
+// deliveries aren't marked done, the next backfill tries them again.
+func backfillDirect(ctx context.Context, storage services.CobaltStorage, queue services.CobaltQueue, db *bolt.DB, progress *backfill.Progress, publisher string, resend bool, deliveries []*services.Object) int {
+
+	stats := publishers.NewStats()
+	control := make(chan bool, 1)
+	go logger(stats, control, os.Stdout)
+
+	env := &publishers.Env{
+		Storage: storage,
+		Queue:   &publishers.DirectQueue{CobaltQueue: queue},
+		Config:  cfg,
+		Stats:   stats,
+		DB:      db,
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+
+	pool := make(chan bool, __workers__)
+	for _, object := range deliveries {
+
+		select {
+		case pool <- true:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		processor, err := publishers.New(publisher, env)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		job := publishers.NewDirectJob(object.Bucket, object.Key, object.Size)
+		job.Resend = resend
+
+		wg.Add(1)
+		go func(processor publishers.Processor, job *publishers.Job) {
+			defer wg.Done()
+			defer func() { <-pool }()
+
+			result := processor.Process(ctx, job)
+			if result.Err == nil {
+				result.Err = progress.Mark(job.Key())
+			}
+			if result.Err != nil {
+				log.Printf("%s: %s: %v", publisher, job.Key(), result.Err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(processor, job)
+	}
+	wg.Wait()
+
+	control <- true
+	<-control
+
+	if ctx.Err() != nil {
+		log.Println("Backfill interrupted, run it again to carry on")
+		return 1
+	}
+	if failed > 0 {
+		log.Printf("%d deliveries failed, run the backfill again to retry them", failed)
+		return 1
+	}
+	return 0
+}
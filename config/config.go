@@ -1,6 +1,17 @@
 package config
 
+import "time"
+
 type Config struct {
+	// Storage is where buckets are, s3 or a file:// URL of a directory
+	// holding a directory per bucket.
+	Storage string
+	// Queue is where messages come from, sqs or a file:// URL of a JSONL
+	// file or directory of recorded events. What a file queue sends is
+	// written to QueueOutput.
+	Queue       string
+	QueueOutput string
+
 	ProcessedBucket string
 	FtpBucket       string
 
@@ -10,4 +21,48 @@ type Config struct {
 	Key    string
 	Secret string
 	Region string
+
+	// PendingTimeout is how long a delivery split over several archives
+	// waits for its missing companions.
+	PendingTimeout time.Duration
+	// OrphanAge is how long the half of a pair waits for its partner to
+	// turn up in a later delivery.
+	OrphanAge time.Duration
+
+	// ManifestPrefix is where in ProcessedBucket the manifest of every
+	// processed archive is written.
+	ManifestPrefix string
+	// ClaimCheckPrefix is where in ProcessedBucket the bodies of messages
+	// too large for SQS are stored.
+	ClaimCheckPrefix string
+
+	// DeadLetterQueue receives jobs that failed MaxAttempts times, empty
+	// leaves them to the queue's own redrive policy.
+	DeadLetterQueue string
+	MaxAttempts     int
+	// RetryBackoff is how long a failed job stays invisible after its
+	// first failure, doubling with every further one.
+	RetryBackoff time.Duration
+	// VisibilityTimeout is how long the message of a running job is hidden
+	// at a time, it is extended for as long as the job runs.
+	VisibilityTimeout time.Duration
+
+	// UploadConcurrency is how many entries of an archive are uploaded at
+	// a time, PublisherConcurrency overrides it for single publishers.
+	UploadConcurrency    int
+	PublisherConcurrency map[string]int
+
+	// Compression maps file extensions to the codec (none, gzip or zstd)
+	// processed objects with the extension are stored with,
+	// PublisherCompression overrides it for single publishers.
+	Compression          map[string]string
+	PublisherCompression map[string]map[string]string
+
+	// Encryption is the server-side encryption of uploads, AES256 or
+	// aws:kms with KMSKeyID. Empty leaves it to the bucket.
+	Encryption string
+	KMSKeyID   string
+	// StorageClass maps content types to the S3 storage class objects of
+	// the type are stored in, the rest are STANDARD.
+	StorageClass map[string]string
 }
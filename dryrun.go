@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/yewno/acquisition/services"
+)
+
+// dryRun wraps storage and queue so what would be uploaded, sent and
+// deleted is recorded to -dry-run-output instead.
+func dryRun(storage services.CobaltStorage, queue services.CobaltQueue) (services.CobaltStorage, services.CobaltQueue, error) {
+
+	recorder, err := services.NewRecorder(__dry_run_output__)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &services.DryRunStorage{CobaltStorage: storage, Recorder: recorder},
+		&services.DryRunQueue{CobaltQueue: queue, Recorder: recorder}, nil
+}
+
+// copyState copies the state database to a temporary file for a dry run
+// to work on, so pending deliveries and orphans are seen but left alone.
+func copyState(filename string) (string, error) {
+
+	temp, err := ioutil.TempFile("", "acquisition-dry-run-")
+	if err != nil {
+		return "", err
+	}
+	defer temp.Close()
+
+	state, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return temp.Name(), nil
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	defer state.Close()
+
+	if _, err := io.Copy(temp, state); err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	return temp.Name(), nil
+}
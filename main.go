@@ -1,25 +1,32 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/yewno/acquisition/config"
 	"github.com/yewno/acquisition/publishers"
-	"github.com/yewno/acquisition/publishers/acm"
-	"github.com/yewno/acquisition/publishers/bmj"
-	"github.com/yewno/acquisition/publishers/cup"
-	"github.com/yewno/acquisition/publishers/nas"
-	"github.com/yewno/acquisition/publishers/oup"
-	"github.com/yewno/acquisition/publishers/pnas"
-	"github.com/yewno/acquisition/publishers/tandf"
+	"github.com/yewno/acquisition/publishers/profile"
+	"github.com/yewno/acquisition/publishers/supervisor"
 	"github.com/yewno/acquisition/services"
+
+	// publishers register their processors on import
+	_ "github.com/yewno/acquisition/publishers/acm"
+	_ "github.com/yewno/acquisition/publishers/nas"
+	_ "github.com/yewno/acquisition/publishers/pnas"
 )
 
 var (
@@ -27,15 +34,43 @@ var (
 
 	__workers__ int
 
-	__processed_bucket__  string
-	__ftp_bucket__        string
-	__new_content_queue__ string
-	__processed_queue__   string
-	__key__               string
-	__secret__            string
-	__region__            string
+	__processed_bucket__   string
+	__ftp_bucket__         string
+	__new_content_queue__  string
+	__processed_queue__    string
+	__key__                string
+	__secret__             string
+	__region__             string
+	__profiles__           string
+	__state__              string
+	__pending_timeout__    time.Duration
+	__orphan_age__         time.Duration
+	__manifest_prefix__    string
+	__claim_check_prefix__ string
+	__dead_letter_queue__  string
+	__max_attempts__       int
+	__retry_backoff__      time.Duration
+	__visibility__         time.Duration
+	__shutdown_timeout__   time.Duration
+
+	__upload_concurrency__    int
+	__publisher_concurrency__ string
+	__compression__           string
+	__publisher_compression__ string
+	__encryption__            string
+	__kms_key_id__            string
+	__storage_class__         string
+	__storage__               string
+	__queue__                 string
+	__queue_output__          string
+	__dry_run__               bool
+	__dry_run_output__        string
 )
 
+// sweepInterval is how often processors holding on to work between jobs
+// are asked to finish what has waited too long.
+const sweepInterval = time.Minute
+
 func init() {
 
 	flag.IntVar(&__workers__, "workers", 2, "number of workers to run")
@@ -46,6 +81,29 @@ func init() {
 	flag.StringVar(&__key__, "key", "", "aws key")
 	flag.StringVar(&__secret__, "secret", "", "aws secret")
 	flag.StringVar(&__region__, "region", "us-west-2", "region")
+	flag.StringVar(&__profiles__, "profiles", "profiles", "directory of publisher profiles")
+	flag.StringVar(&__state__, "state", "acquisition.db", "local database of state kept between runs")
+	flag.DurationVar(&__pending_timeout__, "pending-timeout", 24*time.Hour, "how long a delivery split over several archives waits for the rest")
+	flag.DurationVar(&__orphan_age__, "orphan-age", 30*24*time.Hour, "how long a file without its pair waits for later deliveries")
+	flag.StringVar(&__manifest_prefix__, "manifest-prefix", "manifests", "prefix in the processed bucket for the manifest of every archive")
+	flag.StringVar(&__claim_check_prefix__, "claim-check-prefix", "claim-checks", "prefix in the processed bucket for messages too large for SQS")
+	flag.StringVar(&__dead_letter_queue__, "dead-letter-queue", "", "queue for jobs that failed max-attempts times, empty leaves them to the queue's redrive policy")
+	flag.IntVar(&__max_attempts__, "max-attempts", 5, "how many times a failing job is tried")
+	flag.DurationVar(&__retry_backoff__, "retry-backoff", time.Minute, "how long a failed job waits before its first retry, doubling with every further one")
+	flag.DurationVar(&__visibility__, "visibility-timeout", 5*time.Minute, "how long the message of a running job is hidden at a time, extended until the job finishes, 0 leaves it to the queue")
+	flag.DurationVar(&__shutdown_timeout__, "shutdown-timeout", time.Minute, "how long archives in progress may take to finish after SIGINT or SIGTERM before they are cancelled and left for redelivery")
+	flag.IntVar(&__upload_concurrency__, "upload-concurrency", 4, "how many entries of an archive are uploaded at a time")
+	flag.StringVar(&__publisher_concurrency__, "publisher-concurrency", "", "upload-concurrency of single publishers, as in pnas=8,bmj=2")
+	flag.StringVar(&__compression__, "compression", ".xml=gzip", "codec (none, gzip or zstd) processed files are stored with per extension, as in .xml=gzip,.json=zstd")
+	flag.StringVar(&__publisher_compression__, "publisher-compression", "", "compression of single publishers, as in pnas:.xml=zstd,acm:.xml=none")
+	flag.StringVar(&__encryption__, "encryption", "", "server-side encryption of uploads, AES256 or aws:kms, empty leaves it to the bucket")
+	flag.StringVar(&__kms_key_id__, "kms-key-id", "", "KMS key of aws:kms encryption")
+	flag.StringVar(&__storage__, "storage", "s3", "where buckets are, s3 or a file:// URL of a directory with a directory per bucket")
+	flag.StringVar(&__queue__, "queue", "sqs", "where messages come from, sqs or a file:// URL of a JSONL file or directory of recorded S3 events")
+	flag.StringVar(&__queue_output__, "queue-output", "sent.jsonl", "JSONL file the messages sent by a file queue are written to")
+	flag.StringVar(&__storage_class__, "storage-class", "", "storage class of uploads per content type, as in application/pdf=STANDARD_IA")
+	flag.BoolVar(&__dry_run__, "dry-run", false, "process archives without uploading, sending or deleting anything, recording it to dry-run-output instead")
+	flag.StringVar(&__dry_run_output__, "dry-run-output", "dry-run.jsonl", "JSONL file a dry run records what it would have uploaded, sent and deleted to")
 
 	log.SetFlags(log.Lshortfile | log.Ltime)
 
@@ -55,7 +113,33 @@ func main() {
 
 	flag.Parse()
 
+	// a dry run can't receive from SQS without hiding the messages from
+	// the running workers
+	if __dry_run__ && flag.Arg(0) == "" && (__queue__ == "" || __queue__ == "sqs") {
+		log.Fatal("-dry-run needs the process or backfill command, or a file:// -queue")
+	}
+
+	concurrency, err := parseConcurrency(__publisher_concurrency__)
+	if err != nil {
+		log.Fatal(err)
+	}
+	compression, err := services.ParseCompression(__compression__)
+	if err != nil {
+		log.Fatal(err)
+	}
+	publisherCompression, err := parsePublisherCompression(__publisher_compression__)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storageClass, err := parsePairs("storage-class", __storage_class__)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	cfg = &config.Config{
+		Storage:     __storage__,
+		Queue:       __queue__,
+		QueueOutput: __queue_output__,
 
 		ProcessedBucket: __processed_bucket__,
 		FtpBucket:       __ftp_bucket__,
@@ -64,39 +148,136 @@ func main() {
 		Key:             __key__,
 		Secret:          __secret__,
 		Region:          __region__,
+
+		PendingTimeout: __pending_timeout__,
+		OrphanAge:      __orphan_age__,
+		ManifestPrefix: __manifest_prefix__,
+
+		ClaimCheckPrefix: __claim_check_prefix__,
+
+		DeadLetterQueue: __dead_letter_queue__,
+		MaxAttempts:     __max_attempts__,
+		RetryBackoff:    __retry_backoff__,
+
+		VisibilityTimeout: __visibility__,
+
+		UploadConcurrency:    __upload_concurrency__,
+		PublisherConcurrency: concurrency,
+
+		Compression:          compression,
+		PublisherCompression: publisherCompression,
+
+		Encryption:   __encryption__,
+		KMSKeyID:     __kms_key_id__,
+		StorageClass: storageClass,
 	}
 
 	log.Println("Starting acquisition ...")
 
+	profiles, err := profile.LoadDir(__profiles__)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range profiles {
+		p.Register()
+	}
+
 	var (
 		wg sync.WaitGroup
 	)
 
-	storage, err := services.NewCobaltS3(cfg)
+	storage, err := services.NewStorage(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	queue, err := services.NewCobaltSqs(cfg, cfg.NewContentQueue, cfg.ProcessedQueue)
+	queues := []string{cfg.NewContentQueue, cfg.ProcessedQueue}
+	if cfg.DeadLetterQueue != "" {
+		queues = append(queues, cfg.DeadLetterQueue)
+	}
+	queue, err := services.NewQueue(cfg, queues...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	state := __state__
+	if __dry_run__ {
+		log.Println("Dry run, recording to", __dry_run_output__)
+		if storage, queue, err = dryRun(storage, queue); err != nil {
+			log.Fatal(err)
+		}
+		if state, err = copyState(__state__); err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(state)
+	}
+
+	db, err := bolt.Open(state, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	exit := func(status int) {
+		db.Close()
+		if __dry_run__ {
+			os.Remove(state)
+		}
+		os.Exit(status)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "process":
+		exit(process(storage, queue, db, flag.Args()[1:]))
+	case "backfill":
+		exit(backfillCommand(storage, queue, db, flag.Args()[1:]))
+	default:
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+
+	// polling stops on the first signal, jobs in flight are only
+	// cancelled once the shutdown timeout has passed
+	polling, stopPolling := context.WithCancel(context.Background())
+	defer stopPolling()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Printf("Received %s, shutting down ...", s)
+		stopPolling()
+	}()
 
 	stats := publishers.NewStats()
 	control := make(chan bool, 1)
-	go logger(stats, control)
+	go logger(stats, control, ioutil.Discard)
+
+	env := &publishers.Env{
+		Storage: storage,
+		Queue:   queue,
+		Config:  cfg,
+		Stats:   stats,
+		DB:      db,
+	}
 
-	pool := make(chan bool, __workers__)
-	for m := range queue.Poll(cfg.NewContentQueue, 1) {
+	jobs := supervisor.New(queue, cfg.NewContentQueue, cfg.DeadLetterQueue, supervisor.Policy{
+		MaxAttempts: cfg.MaxAttempts,
+		Backoff:     cfg.RetryBackoff,
+		Visibility:  cfg.VisibilityTimeout,
+	}, db)
 
-		select {
-		case <-sig:
-			goto PollBreak
-		default:
-		}
+	stopSweep := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sweeper(ctx, env, stopSweep)
+	}()
+
+	pool := make(chan bool, __workers__)
+	for m := range queue.Poll(polling, cfg.NewContentQueue, 1) {
 
 		if m == nil {
 			log.Println("No messages received")
@@ -107,49 +288,174 @@ func main() {
 		if err != nil {
 			log.Println(m.Body)
 			log.Println(err)
+			jobs.Failed(m, nil, err)
 			continue
 		}
 
-		publisher := strings.Split(message.Records[0].S3.Object.Key, "/")[1]
-
-		switch publisher {
-		case "pnas":
-			obj := pnas.NewObject(storage, queue, &wg, cfg, pool, stats)
-			go obj.Process(m.Receipt, message)
-		case "bmj":
-			obj := bmj.NewObject(storage, queue, &wg, cfg, pool, stats)
-			go obj.Process(m.Receipt, message)
-		case "cup":
-			obj := cup.NewObject(storage, queue, &wg, cfg, pool, stats)
-			go obj.Process(m.Receipt, message)
-		case "tandf":
-			obj := tandf.NewObject(storage, queue, &wg, cfg, pool, stats)
-			go obj.Process(m.Receipt, message)
-		case "oup":
-			obj := oup.NewObject(storage, queue, &wg, cfg, pool, stats)
-			go obj.Process(m.Receipt, message)
-		case "acm":
-			obj := acm.NewObject(storage, queue, &wg, cfg, pool, stats)
-			go obj.Process(m.Receipt, message)
-		case "nas":
-			obj := nas.NewObject(storage, queue, &wg, cfg, pool, stats)
-			go obj.Process(m.Receipt, message)
-		default:
-			log.Printf("Missing process for (%s)", publisher)
+		job := publishers.NewJob(m.Receipt, message)
+		job.Attempts = m.Attempts
+
+		processor, err := publishers.New(job.Publisher(), env)
+		if err != nil {
+			log.Println(err)
+			jobs.Failed(m, job, err)
 			continue
 		}
 
-		pool <- true
+		wg.Add(1)
+		go func(job *publishers.Job, m *services.Message) {
+			defer wg.Done()
+			defer func() { <-pool }()
+
+			result := jobs.Run(ctx, processor, job, m)
+			if result.Err != nil {
+				log.Printf("%s: %s: %v", result.Publisher, job.Key(), result.Err)
+			}
+		}(job, m)
+
+		select {
+		case pool <- true:
+		case <-polling.Done():
+			goto PollBreak
+		}
 	}
 
 PollBreak:
-	wg.Wait()
+	shutdown(polling, cancel, &wg, stopSweep)
 	control <- true
 	log.Println("Done")
 	<-control
 
 }
 
+// shutdown waits for the jobs in flight and the sweeper to finish. After a
+// signal they get the shutdown timeout to do so, then they are cancelled.
+func shutdown(polling context.Context, cancel context.CancelFunc, wg *sync.WaitGroup, stopSweep chan bool) {
+
+	close(stopSweep)
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-polling.Done():
+	}
+
+	select {
+	case <-done:
+	case <-time.After(__shutdown_timeout__):
+		log.Println("Shutdown timeout passed, cancelling jobs in flight")
+		cancel()
+		<-done
+	}
+}
+
+// sweeper runs the sweep of every processor that implements
+// publishers.Sweeper, once at start and then every sweepInterval until stop
+// is closed.
+func sweeper(ctx context.Context, env *publishers.Env, stop chan bool) {
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, name := range publishers.Registered() {
+			processor, err := publishers.New(name, env)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			sweeper, ok := processor.(publishers.Sweeper)
+			if !ok {
+				continue
+			}
+
+			for _, result := range sweeper.Sweep(ctx) {
+				if result.Err != nil {
+					log.Printf("%s: sweep: %v", result.Publisher, result.Err)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// parseConcurrency reads a list of publisher=n pairs.
+func parseConcurrency(s string) (map[string]int, error) {
+
+	pairs, err := parsePairs("publisher-concurrency", s)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := make(map[string]int, len(pairs))
+	for publisher, value := range pairs {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("publisher-concurrency: %s=%s isn't publisher=n", publisher, value)
+		}
+		concurrency[publisher] = n
+	}
+	return concurrency, nil
+}
+
+// parsePublisherCompression reads a list of publisher:extension=codec
+// pairs.
+func parsePublisherCompression(s string) (map[string]map[string]string, error) {
+
+	pairs, err := parsePairs("publisher-compression", s)
+	if err != nil {
+		return nil, err
+	}
+
+	compression := make(map[string]map[string]string)
+	for key, codec := range pairs {
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("publisher-compression: %s=%s isn't publisher:extension=codec", key, codec)
+		}
+		if compression[parts[0]] == nil {
+			compression[parts[0]] = make(map[string]string)
+		}
+		compression[parts[0]][parts[1]] = codec
+	}
+
+	for publisher, c := range compression {
+		if err := services.Compression(c).Validate(); err != nil {
+			return nil, fmt.Errorf("publisher-compression: %s: %v", publisher, err)
+		}
+	}
+	return compression, nil
+}
+
+// parsePairs reads a list of key=value pairs given to the flag.
+func parsePairs(name, s string) (map[string]string, error) {
+
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: %q isn't key=value", name, pair)
+		}
+		pairs[parts[0]] = parts[1]
+	}
+	return pairs, nil
+}
+
 func parse(msg string) (*services.SnsMessage, error) {
 
 	message := &services.SnsMessage{}
@@ -158,7 +464,9 @@ func parse(msg string) (*services.SnsMessage, error) {
 	return message, err
 }
 
-func logger(stats *publishers.Stats, control chan bool) {
+// logger counts the stats into report.log until control is signalled,
+// echoing the report to echo.
+func logger(stats *publishers.Stats, control chan bool, echo io.Writer) {
 	var (
 		archive         int
 		meta            int
@@ -167,6 +475,9 @@ func logger(stats *publishers.Stats, control chan bool) {
 		pairs           int
 		missingMeta     int
 		missingContent  int
+		unmatched       int
+		skipped         int
+		skippedPairs    int
 		publisherReport = make(map[string]int64, 10)
 	)
 
@@ -176,7 +487,7 @@ func logger(stats *publishers.Stats, control chan bool) {
 	}
 	defer file.Close()
 
-	logger := log.New(file, "", log.LstdFlags)
+	logger := log.New(io.MultiWriter(file, echo), "", log.LstdFlags)
 
 	for {
 		select {
@@ -194,6 +505,12 @@ func logger(stats *publishers.Stats, control chan bool) {
 			missingMeta++
 		case <-stats.MissingContent:
 			missingContent++
+		case <-stats.Unmatched:
+			unmatched++
+		case <-stats.Skipped:
+			skipped++
+		case <-stats.SkippedPairs:
+			skippedPairs++
 		case fn := <-stats.ProblemFilenames:
 			logger.Println(fn)
 		case report := <-stats.Report:
@@ -211,7 +528,7 @@ func logger(stats *publishers.Stats, control chan bool) {
 		}
 	}
 LogBreak:
-	logger.Printf(logFormat, archive, meta, content, other, pairs, missingMeta, missingContent)
+	logger.Printf(logFormat, archive, meta, content, other, pairs, missingMeta, missingContent, unmatched, skipped, skippedPairs)
 
 	for k, v := range publisherReport {
 		logger.Printf("%s: %d", k, v)
@@ -242,4 +559,13 @@ MissingMeta   : %d
 
 Meta objects without content objects
 MissingContent: %d
+
+Objects that never found their pair
+Unmatched     : %d
+
+Objects not uploaded again because their content didn't change
+Skipped       : %d
+
+Pairs not sent again because neither half changed
+SkippedPairs  : %d
 `
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/services"
+)
+
+// process runs the job of a single archive given as s3://bucket/key, in
+// place of a message on the new content queue, and prints the report. It
+// returns the exit status.
+//
+//	acquisition process --publisher bmj s3://yewno-ftp/files/bmj/x.tar.gz
+func process(storage services.CobaltStorage, queue services.CobaltQueue, db *bolt.DB, args []string) int {
+
+	flags := flag.NewFlagSet("process", flag.ExitOnError)
+	publisher := flags.String("publisher", "", "publisher of the archive, by default the directory under files/ it is in")
+	resend := flags.Bool("resend", false, "send the pairs of unchanged files again")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: acquisition [flags] process [--publisher name] [--resend] s3://bucket/key")
+		return 2
+	}
+	bucket, key, err := parseLocation(flags.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	object := services.NewObject(nil, bucket, key, 0)
+	if err := storage.Head(ctx, object); err != nil {
+		log.Printf("%s: %v", flags.Arg(0), err)
+		return 1
+	}
+
+	job := publishers.NewDirectJob(bucket, key, object.Size)
+	job.Resend = *resend
+	if *publisher == "" {
+		*publisher = job.Publisher()
+	}
+
+	stats := publishers.NewStats()
+	control := make(chan bool, 1)
+	go logger(stats, control, os.Stdout)
+
+	env := &publishers.Env{
+		Storage: storage,
+		Queue:   &publishers.DirectQueue{CobaltQueue: queue},
+		Config:  cfg,
+		Stats:   stats,
+		DB:      db,
+	}
+	processor, err := publishers.New(*publisher, env)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	result := processor.Process(ctx, job)
+
+	control <- true
+	<-control
+
+	if result.Err != nil {
+		log.Printf("%s: %s: %v", result.Publisher, key, result.Err)
+		return 1
+	}
+	return 0
+}
+
+// parseLocation splits s3://bucket/key.
+func parseLocation(location string) (string, string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "s3" || u.Host == "" || key == "" {
+		return "", "", fmt.Errorf("%q isn't s3://bucket/key", location)
+	}
+	return u.Host, key, nil
+}
@@ -2,42 +2,46 @@ package acm
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"strings"
-	"sync"
 
 	"golang.org/x/net/html/charset"
 
 	"github.com/yewno/acquisition/config"
 	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/publishers/archive"
+	"github.com/yewno/acquisition/publishers/manifest"
 	"github.com/yewno/acquisition/services"
 )
 
 type Object struct {
 	conn  services.CobaltStorage
 	queue services.CobaltQueue
-	wg    *sync.WaitGroup
 	cfg   *config.Config
-	pool  chan bool
 
 	stats *publishers.Stats
+
+	// resend is set while processing a redelivered job, its unchanged
+	// records are sent again.
+	resend bool
+}
+
+func init() {
+	publishers.Register("acm", NewObject)
 }
 
-func NewObject(conn services.CobaltStorage, queue services.CobaltQueue, wg *sync.WaitGroup, cfg *config.Config, pool chan bool, stats *publishers.Stats) *Object {
-	wg.Add(1)
+func NewObject(env *publishers.Env) publishers.Processor {
 	return &Object{
-		conn:  conn,
-		queue: queue,
-		wg:    wg,
-		cfg:   cfg,
-		pool:  pool,
+		conn:  env.Storage,
+		queue: env.Queue,
+		cfg:   env.Config,
 
-		stats: stats,
+		stats: env.Stats,
 	}
 }
 
@@ -48,38 +52,50 @@ func getBaseKey(filename string) string {
 	return fileParts[0]
 }
 
-func (o *Object) UploadACM(key string, bytesArr []byte) error {
+// UploadACM saves a single article record and returns the key it is
+// stored under, compressed, and whether it changed since it was last
+// uploaded.
+func (o *Object) UploadACM(ctx context.Context, record *manifest.Manifest, key string, bytesArr []byte) (string, bool, error) {
 
 	file, err := ioutil.TempFile("", "")
 	if err != nil {
 		log.Println(err)
-		return err
+		return key, false, err
 	}
 
 	size, err := file.Write(bytesArr)
 	if err != nil {
 		log.Println(err)
-		return err
+		return key, false, err
 	}
 
 	_, err = file.Seek(0, 0)
 	if err != nil {
 		log.Println(err)
-		return err
+		return key, false, err
 	}
 
 	object := services.NewObject(file, o.cfg.ProcessedBucket, key, int64(size))
+	object.Compression = publishers.Compression(o.cfg, "acm", nil)
+	object.Tags = publishers.Tags("acm", record.Key, publishers.Meta)
 
-	err = object.Save(o.conn)
+	err = object.Save(ctx, o.conn)
 	if err != nil {
 		log.Println(err)
 	}
 	object.Close()
+	record.Add(record.Key, key, object, publishers.Meta)
 
-	return err
+	if object.Unchanged {
+		o.stats.Skipped <- 1
+		if !o.resend {
+			o.stats.SkippedPairs <- 1
+		}
+	}
+	return object.Key, !object.Unchanged || o.resend, err
 }
 
-func (o *Object) ProcessProceeding(filename string, bytesArr []byte) ([]string, error) {
+func (o *Object) ProcessProceeding(ctx context.Context, record *manifest.Manifest, filename string, bytesArr []byte) ([]string, error) {
 	v := new(ACMProceedings)
 	decoder := xml.NewDecoder(bytes.NewReader(bytesArr))
 	decoder.CharsetReader = charset.NewReaderLabel
@@ -108,12 +124,14 @@ func (o *Object) ProcessProceeding(filename string, bytesArr []byte) ([]string,
 			}
 
 			key := fmt.Sprintf("acm/%s-%s.xml", baseName, p.Article.ID)
-			err = o.UploadACM(key, bytesArr)
+			stored, changed, err := o.UploadACM(ctx, record, key, bytesArr)
 
 			if err != nil {
 				return keys, err
 			}
-			keys = append(keys, key)
+			if changed {
+				keys = append(keys, stored)
+			}
 		}
 	}
 
@@ -129,17 +147,19 @@ func (o *Object) ProcessProceeding(filename string, bytesArr []byte) ([]string,
 		}
 
 		key := fmt.Sprintf("acm/%s-%s.xml", baseName, p.Article.ID)
-		err = o.UploadACM(key, bytesArr)
+		stored, changed, err := o.UploadACM(ctx, record, key, bytesArr)
 
 		if err != nil {
 			return keys, err
 		}
-		keys = append(keys, key)
+		if changed {
+			keys = append(keys, stored)
+		}
 	}
 	return keys, nil
 }
 
-func (o *Object) ProcessPeriodical(filename string, bytesArr []byte) ([]string, error) {
+func (o *Object) ProcessPeriodical(ctx context.Context, record *manifest.Manifest, filename string, bytesArr []byte) ([]string, error) {
 	v := new(ACMPeriodicals)
 	keys := make([]string, 0, 100)
 	decoder := xml.NewDecoder(bytes.NewReader(bytesArr))
@@ -167,12 +187,14 @@ func (o *Object) ProcessPeriodical(filename string, bytesArr []byte) ([]string,
 			}
 
 			key := fmt.Sprintf("acm/%s-%s.xml", baseName, p.Article.ID)
-			err = o.UploadACM(key, bytesArr)
+			stored, changed, err := o.UploadACM(ctx, record, key, bytesArr)
 
 			if err != nil {
 				return keys, err
 			}
-			keys = append(keys, key)
+			if changed {
+				keys = append(keys, stored)
+			}
 		}
 	}
 
@@ -188,82 +210,117 @@ func (o *Object) ProcessPeriodical(filename string, bytesArr []byte) ([]string,
 		}
 
 		key := fmt.Sprintf("acm/%s-%s.xml", baseName, p.Article.ID)
-		err = o.UploadACM(key, bytesArr)
+		stored, changed, err := o.UploadACM(ctx, record, key, bytesArr)
 
 		if err != nil {
 			return keys, err
 		}
-		keys = append(keys, key)
+		if changed {
+			keys = append(keys, stored)
+		}
 	}
 	return keys, nil
 }
 
-func (o *Object) Process(receipt string, message *services.SnsMessage) error {
+func (o *Object) Process(ctx context.Context, job *publishers.Job) publishers.Result {
+	o.resend = job.Redelivered()
+	count, err := o.process(ctx, job)
+	return publishers.Result{Publisher: "acm", Pairs: count, Err: err}
+}
 
-	defer o.wg.Done()
-	defer func() { <-o.pool }()
+func (o *Object) process(ctx context.Context, job *publishers.Job) (int, error) {
 
 	var (
-		bucket = message.Records[0].S3.Bucket.Name
-		key    = message.Records[0].S3.Object.Key
-		size   = message.Records[0].S3.Object.Size
+		bucket = job.Bucket()
+		key    = job.Key()
+		size   = job.Size()
 		keys   = make([]string, 0, 100)
 	)
 	log.Println(bucket, key, size)
 
 	object := services.NewObject(nil, bucket, key, size)
 
-	if err := o.conn.Get(object); err != nil {
-		return err
+	if err := o.conn.Get(ctx, object); err != nil {
+		return 0, err
 	}
 	defer object.Close()
 
-	reader, err := gzip.NewReader(object.File)
+	record := manifest.New("acm", key)
+	if err := record.Source(object); err != nil {
+		log.Println(err)
+	}
+
+	reader, err := archive.Open(object.File, object.Size, key)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	entry, err := reader.Next()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	bytesArr, err := ioutil.ReadAll(reader)
+	bytesArr, err := ioutil.ReadAll(entry)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	reader.Close()
 	//bytesArr = carbon.CleanXML(bytesArr)
 
 	if bytes.Contains(bytesArr, []byte("<periodical ")) {
-		keys, err = o.ProcessPeriodical(key, bytesArr)
+		keys, err = o.ProcessPeriodical(ctx, record, key, bytesArr)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	} else if bytes.Contains(bytesArr, []byte("<proceeding ")) {
-		keys, err = o.ProcessProceeding(key, bytesArr)
+		keys, err = o.ProcessProceeding(ctx, record, key, bytesArr)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	} else {
 		err = errors.New("unknown format")
-		return err
+		return 0, err
 	}
 
-	batch := o.queue.NewBatch(o.cfg.ProcessedQueue)
+	var sendErr error
+	batch := o.queue.NewBatch(ctx, o.cfg.ProcessedQueue)
 	count := 0
 	for _, key := range keys {
 		m := services.PairMessage{
 			Source: "acm",
 			Bucket: o.cfg.ProcessedBucket,
-			Key:    fmt.Sprintf("%s.gz", key),
+			Key:    key,
+		}
+		if err := batch.Add(m); err != nil {
+			log.Println(err)
+			sendErr = err
+			continue
 		}
-		batch.Add(m)
+		record.Sent(&m)
 		count++
 	}
 	o.stats.Report <- fmt.Sprintf("acm:%d", count)
-	batch.Flush()
+	if err := batch.Flush(); err != nil {
+		// the message isn't deleted, it comes back to send the pairs again
+		log.Println(err)
+		return count, err
+	}
+	if sendErr != nil {
+		return count, sendErr
+	}
+	if ctx.Err() != nil {
+		return count, ctx.Err()
+	}
+
+	if err := record.Save(ctx, o.conn, o.cfg.ProcessedBucket, o.cfg.ManifestPrefix); err != nil {
+		log.Println(err)
+	}
 
-	if err = o.queue.Pop(o.cfg.NewContentQueue, receipt); err != nil {
+	if err = o.queue.Pop(ctx, o.cfg.NewContentQueue, job.Receipt); err != nil {
 		log.Println(err)
-		return err
+		return count, err
 	}
-	return nil
+	return count, nil
 }
 
 type ACMArticle struct {
@@ -0,0 +1,323 @@
+// Package archive reads the containers publishers deliver content in. The
+// format of a delivery is detected from its first bytes, so a publisher
+// switching from zip to tar.gz (or to a bare gzip) needs no code change.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Format is a container or compression format.
+type Format string
+
+const (
+	Unknown Format = ""
+	Zip     Format = "zip"
+	Tar     Format = "tar"
+	Gzip    Format = "gzip"
+	Bzip2   Format = "bzip2"
+	Xz      Format = "xz"
+)
+
+// ErrFormat is returned when the data is not in a supported format.
+var ErrFormat = errors.New("archive: unknown format")
+
+// headerSize is how much of a stream is needed to tell formats apart, the
+// tar magic sits at offset 257.
+const headerSize = 512
+
+var magics = []struct {
+	format Format
+	offset int
+	magic  []byte
+}{
+	{Zip, 0, []byte("PK\x03\x04")},
+	{Zip, 0, []byte("PK\x05\x06")},
+	{Gzip, 0, []byte{0x1f, 0x8b}},
+	{Bzip2, 0, []byte("BZh")},
+	{Xz, 0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{Tar, 257, []byte("ustar")},
+}
+
+// Detect returns the format of the data starting with header.
+func Detect(header []byte) Format {
+	for _, m := range magics {
+		if len(header) >= m.offset+len(m.magic) && bytes.Equal(header[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.format
+		}
+	}
+	return Unknown
+}
+
+// Entry is a regular file inside an archive. Reading from the entry reads
+// its content and is only valid until the next call to Next.
+type Entry struct {
+	io.Reader
+
+	Name string
+	// Size is the uncompressed size of the entry, -1 if it isn't known
+	// up front (single file gzip, bzip2 and xz).
+	Size int64
+	Mode os.FileMode
+}
+
+// Reader iterates over the regular files of an archive.
+type Reader interface {
+	// Next advances to the next entry, returning io.EOF at the end.
+	Next() (*Entry, error)
+	Close() error
+}
+
+// Open returns a reader for the archive in r. Zip archives are read in
+// place, every other format is streamed. name is the file name of the
+// archive and is used to name the entry of single file compressed formats.
+func Open(r io.ReaderAt, size int64, name string) (Reader, error) {
+
+	header := make([]byte, headerSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if Detect(header[:n]) == Zip {
+		return newZipReader(r, size, nil)
+	}
+	return NewReader(io.NewSectionReader(r, 0, size), name)
+}
+
+// NewReader returns a reader for the archive streamed from r. Zip archives
+// can't be read from a stream and are spooled to a temp file first.
+func NewReader(r io.Reader, name string) (Reader, error) {
+
+	buffered := bufio.NewReaderSize(r, headerSize)
+	header, err := buffered.Peek(headerSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch Detect(header) {
+	case Zip:
+		return spoolZip(buffered)
+
+	case Tar:
+		return newTarReader(buffered, nil), nil
+
+	case Gzip:
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		if gzipReader.Name != "" {
+			name = gzipReader.Name
+		} else {
+			name = strings.TrimSuffix(name, ".gz")
+		}
+		return decompressed(gzipReader, gzipReader, name)
+
+	case Bzip2:
+		return decompressed(bzip2.NewReader(buffered), nil, strings.TrimSuffix(name, ".bz2"))
+
+	case Xz:
+		xzReader, err := xz.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decompressed(xzReader, nil, strings.TrimSuffix(name, ".xz"))
+	}
+	return nil, ErrFormat
+}
+
+// decompressed looks inside a compressed stream for a tar archive, anything
+// else is returned as a single entry.
+func decompressed(r io.Reader, closer io.Closer, name string) (Reader, error) {
+
+	buffered := bufio.NewReaderSize(r, headerSize)
+	header, err := buffered.Peek(headerSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if Detect(header) == Tar {
+		return newTarReader(buffered, closer), nil
+	}
+
+	return &singleReader{
+		entry:  &Entry{Reader: buffered, Name: path.Base(name), Size: -1, Mode: 0644},
+		closer: closer,
+	}, nil
+}
+
+// Stem is the file name of an archive without its archive extensions.
+func Stem(name string) string {
+
+	fn := path.Base(name)
+	for _, ext := range []string{
+		".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz",
+		".tar", ".zip", ".gz", ".bz2", ".xz",
+	} {
+		if strings.HasSuffix(fn, ext) {
+			return strings.TrimSuffix(fn, ext)
+		}
+	}
+	return strings.TrimSuffix(fn, path.Ext(fn))
+}
+
+type zipReader struct {
+	files   []*zip.File
+	current io.ReadCloser
+	spool   *os.File
+}
+
+func newZipReader(r io.ReaderAt, size int64, spool *os.File) (*zipReader, error) {
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &zipReader{files: reader.File, spool: spool}, nil
+}
+
+func spoolZip(r io.Reader) (Reader, error) {
+
+	temp, size, err := spoolFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newZipReader(temp, size, temp)
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, err
+	}
+	return reader, nil
+}
+
+// spoolFile copies r to a temp file. The caller removes the file.
+func spoolFile(r io.Reader) (*os.File, int64, error) {
+
+	temp, err := ioutil.TempFile("", "")
+	if err != nil {
+		return nil, -1, err
+	}
+
+	size, err := io.Copy(temp, r)
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, -1, err
+	}
+	return temp, size, nil
+}
+
+func (z *zipReader) Next() (*Entry, error) {
+
+	if z.current != nil {
+		z.current.Close()
+		z.current = nil
+	}
+
+	for len(z.files) > 0 {
+		file := z.files[0]
+		z.files = z.files[1:]
+
+		if !file.Mode().IsRegular() {
+			continue
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		z.current = f
+
+		return &Entry{
+			Reader: f,
+			Name:   file.Name,
+			Size:   int64(file.UncompressedSize64),
+			Mode:   file.Mode(),
+		}, nil
+	}
+	return nil, io.EOF
+}
+
+func (z *zipReader) Close() error {
+	if z.current != nil {
+		z.current.Close()
+	}
+	if z.spool != nil {
+		z.spool.Close()
+		return os.Remove(z.spool.Name())
+	}
+	return nil
+}
+
+type tarReader struct {
+	reader *tar.Reader
+	closer io.Closer
+}
+
+func newTarReader(r io.Reader, closer io.Closer) *tarReader {
+	return &tarReader{reader: tar.NewReader(r), closer: closer}
+}
+
+func (t *tarReader) Next() (*Entry, error) {
+	for {
+		header, err := t.reader.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		info := header.FileInfo()
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		return &Entry{
+			Reader: t.reader,
+			Name:   header.Name,
+			Size:   header.Size,
+			Mode:   info.Mode(),
+		}, nil
+	}
+}
+
+func (t *tarReader) Close() error {
+	if t.closer != nil {
+		return t.closer.Close()
+	}
+	return nil
+}
+
+type singleReader struct {
+	entry  *Entry
+	closer io.Closer
+}
+
+func (s *singleReader) Next() (*Entry, error) {
+	if s.entry == nil {
+		return nil, io.EOF
+	}
+	entry := s.entry
+	s.entry = nil
+	return entry, nil
+}
+
+func (s *singleReader) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
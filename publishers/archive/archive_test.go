@@ -0,0 +1,254 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var files = map[string]string{
+	"a/1.pdf": "pdf",
+	"a/1.xml": "<xml/>",
+}
+
+func zipBytes(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	if _, err := w.Create("a/"); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(body))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarBytes(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	w.WriteHeader(&tar.Header{Name: "a/", Mode: 0755, Typeflag: tar.TypeDir, Format: tar.FormatUSTAR})
+	for name, body := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg, Format: tar.FormatUSTAR}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, name string, b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Name = name
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readAll(t *testing.T, reader Reader) map[string]string {
+	defer reader.Close()
+
+	entries := make(map[string]string)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[entry.Name] = string(b)
+	}
+	return entries
+}
+
+func fixture(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestOpen(t *testing.T) {
+
+	cases := []struct {
+		name   string
+		data   []byte
+		format Format
+	}{
+		{"issue.zip", zipBytes(t, files), Zip},
+		{"issue.tar", tarBytes(t, files), Tar},
+		{"issue.tar.gz", gzipBytes(t, "", tarBytes(t, files)), Gzip},
+		{"issue.tar.bz2", fixture(t, "testdata/issue.tar.bz2"), Bzip2},
+		{"issue.tar.xz", fixture(t, "testdata/issue.tar.xz"), Xz},
+		// extensions are ignored, only the content counts
+		{"issue.tar.gz", zipBytes(t, files), Zip},
+	}
+
+	for _, c := range cases {
+		if format := Detect(c.data); format != c.format {
+			t.Errorf("%s: expected format (%s) got (%s)", c.name, c.format, format)
+		}
+
+		reader, err := Open(bytes.NewReader(c.data), int64(len(c.data)), c.name)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if entries := readAll(t, reader); !reflect.DeepEqual(entries, files) {
+			t.Errorf("%s: unexpected entries %v", c.name, entries)
+		}
+	}
+}
+
+func TestNewReaderSpoolsZip(t *testing.T) {
+
+	data := zipBytes(t, files)
+	reader, err := NewReader(bytes.NewReader(data), "issue.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool := reader.(*zipReader).spool.Name()
+	if entries := readAll(t, reader); !reflect.DeepEqual(entries, files) {
+		t.Errorf("unexpected entries %v", entries)
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("expected spool file to be removed, got %v", err)
+	}
+}
+
+func TestSingleGzip(t *testing.T) {
+
+	cases := []struct {
+		header string
+		name   string
+		entry  string
+	}{
+		{"", "files/acm/proc-123.xml.gz", "proc-123.xml"},
+		{"original.xml", "files/acm/proc-123.xml.gz", "original.xml"},
+	}
+
+	for _, c := range cases {
+		data := gzipBytes(t, c.header, []byte("<proceeding />"))
+		reader, err := Open(bytes.NewReader(data), int64(len(data)), c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries := readAll(t, reader)
+		if !reflect.DeepEqual(entries, map[string]string{c.entry: "<proceeding />"}) {
+			t.Errorf("%s: unexpected entries %v", c.name, entries)
+		}
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+
+	data := []byte("%PDF-1.4 not an archive")
+	if _, err := Open(bytes.NewReader(data), int64(len(data)), "a.pdf"); err != ErrFormat {
+		t.Errorf("expected ErrFormat got %v", err)
+	}
+}
+
+func TestStem(t *testing.T) {
+
+	names := map[string]string{
+		"files/bmj/bmj_2016_01.tar.gz":  "bmj_2016_01",
+		"files/oup/oup_2016_01.tar":     "oup_2016_01",
+		"files/cup/CUP_2016_01.zip":     "CUP_2016_01",
+		"files/acm/proc.xml.gz":         "proc.xml",
+		"files/oup/oup_2016_02.tar.bz2": "oup_2016_02",
+	}
+
+	for key, name := range names {
+		if stem := Stem(key); stem != name {
+			t.Errorf("%s: expected (%s) got (%s)", key, name, stem)
+		}
+	}
+}
+
+func TestNested(t *testing.T) {
+
+	inner := zipBytes(t, files)
+	innerTar := gzipBytes(t, "", tarBytes(t, files))
+	single := gzipBytes(t, "", []byte("<xml/>"))
+
+	outer := zipBytes(t, map[string]string{
+		"issue-1.zip":    string(inner),
+		"issue-2.tar.gz": string(innerTar),
+		"a/2.xml.gz":     string(single),
+		"cover.pdf":      "pdf",
+	})
+
+	open := func(depth int) Reader {
+		reader, err := Open(bytes.NewReader(outer), int64(len(outer)), "delivery.zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Nested(reader, depth)
+	}
+
+	expected := map[string]string{
+		"issue-1.zip/a/1.pdf":    "pdf",
+		"issue-1.zip/a/1.xml":    "<xml/>",
+		"issue-2.tar.gz/a/1.pdf": "pdf",
+		"issue-2.tar.gz/a/1.xml": "<xml/>",
+		"a/2.xml.gz":             string(single),
+		"cover.pdf":              "pdf",
+	}
+	if entries := readAll(t, open(1)); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries %v", entries)
+	}
+
+	expected = map[string]string{
+		"issue-1.zip":    string(inner),
+		"issue-2.tar.gz": string(innerTar),
+		"a/2.xml.gz":     string(single),
+		"cover.pdf":      "pdf",
+	}
+	if entries := readAll(t, open(0)); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries at depth 0 %v", entries)
+	}
+}
+
+func TestNestedDepth(t *testing.T) {
+
+	inner := zipBytes(t, files)
+	middle := zipBytes(t, map[string]string{"issue.zip": string(inner)})
+	outer := zipBytes(t, map[string]string{"volume.zip": string(middle)})
+
+	reader, err := Open(bytes.NewReader(outer), int64(len(outer)), "delivery.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"volume.zip/issue.zip": string(inner)}
+	if entries := readAll(t, Nested(reader, 1)); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries %v", entries)
+	}
+}
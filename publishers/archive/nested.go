@@ -0,0 +1,135 @@
+package archive
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+)
+
+// Nested returns a reader that descends into archives found inside r, up to
+// depth levels deep, instead of returning them as entries. Entries of a
+// nested archive are named after the path of the archive they came from,
+// so "issue-1.zip" holding "a/1.pdf" yields "issue-1.zip/a/1.pdf". A depth
+// of zero returns r unchanged.
+//
+// Compressed entries that turn out to hold a single file rather than a tar
+// archive (article.xml.gz) are returned as they are.
+func Nested(r Reader, depth int) Reader {
+	if depth <= 0 {
+		return r
+	}
+	return &nestedReader{
+		stack: []*level{{reader: r}},
+		depth: depth,
+	}
+}
+
+type level struct {
+	reader Reader
+	prefix string
+	spool  *os.File
+}
+
+func (l *level) close() error {
+	err := l.reader.Close()
+	if l.spool != nil {
+		l.spool.Close()
+		os.Remove(l.spool.Name())
+	}
+	return err
+}
+
+type nestedReader struct {
+	stack []*level
+	depth int
+
+	// current is the spool backing the last returned entry
+	current *os.File
+}
+
+func (n *nestedReader) Next() (*Entry, error) {
+
+	n.release()
+
+	for len(n.stack) > 0 {
+		top := n.stack[len(n.stack)-1]
+
+		entry, err := top.reader.Next()
+		if err == io.EOF {
+			top.close()
+			n.stack = n.stack[:len(n.stack)-1]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry.Name = path.Join(top.prefix, entry.Name)
+
+		if len(n.stack) > n.depth {
+			return entry, nil
+		}
+
+		buffered := bufio.NewReaderSize(entry.Reader, headerSize)
+		entry.Reader = buffered
+
+		header, err := buffered.Peek(headerSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		switch Detect(header) {
+		case Tar:
+			n.stack = append(n.stack, &level{reader: newTarReader(buffered, nil), prefix: entry.Name})
+
+		case Zip, Gzip, Bzip2, Xz:
+			spool, size, err := spoolFile(buffered)
+			if err != nil {
+				return nil, err
+			}
+
+			reader, err := Open(spool, size, entry.Name)
+			if err == nil {
+				if _, single := reader.(*singleReader); !single {
+					n.stack = append(n.stack, &level{reader: reader, prefix: entry.Name, spool: spool})
+					continue
+				}
+				reader.Close()
+			}
+
+			// not an archive after all, hand out the spooled bytes
+			if _, err := spool.Seek(0, 0); err != nil {
+				return nil, err
+			}
+			n.current = spool
+			entry.Reader = spool
+			entry.Size = size
+			return entry, nil
+
+		default:
+			return entry, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+func (n *nestedReader) Close() error {
+	n.release()
+
+	var err error
+	for i := len(n.stack) - 1; i >= 0; i-- {
+		if e := n.stack[i].close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	n.stack = nil
+	return err
+}
+
+func (n *nestedReader) release() {
+	if n.current != nil {
+		n.current.Close()
+		os.Remove(n.current.Name())
+		n.current = nil
+	}
+}
@@ -0,0 +1,160 @@
+// Package backfill selects the historic deliveries of a publisher to
+// process again, after a change to its pairing rule say, and remembers
+// which are done so an interrupted backfill picks up where it stopped.
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/services"
+)
+
+// ErrNoDB is returned when progress has no state database to write to.
+var ErrNoDB = errors.New("backfill: no state database")
+
+// Filter selects deliveries by when they were uploaded and by key. The
+// zero value selects all of them.
+type Filter struct {
+	// Since and Until bound the time of upload, Until excluded. Zero
+	// leaves the bound open.
+	Since time.Time
+	Until time.Time
+	// Pattern, if set, has to match the key.
+	Pattern *regexp.Regexp
+	// Delivery, if set, names the delivery of an archive, for publishers
+	// that split deliveries over several archives. Only the first
+	// archive of each delivery is selected.
+	Delivery func(key string) string
+}
+
+// Match reports whether the filter selects the delivery.
+func (f *Filter) Match(object *services.Object) bool {
+	if !f.Since.IsZero() && object.Modified.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !object.Modified.Before(f.Until) {
+		return false
+	}
+	if f.Pattern != nil && !f.Pattern.MatchString(object.Key) {
+		return false
+	}
+	return true
+}
+
+// Deliveries lists the deliveries of the publisher under files/<publisher>/
+// of the bucket that the filter selects and progress hasn't done yet, in
+// the order of their keys. A delivery split over several archives is
+// listed once.
+func Deliveries(ctx context.Context, storage services.CobaltStorage, bucket, publisher string, filter *Filter, progress *Progress) ([]*services.Object, error) {
+
+	objects, err := storage.List(ctx, bucket, fmt.Sprintf("files/%s/", publisher))
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := progress.Done()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]*services.Object, 0, len(objects))
+	seen := make(map[string]bool)
+	for _, object := range objects {
+		// S3 consoles create "directories" as empty keys ending in /
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		if !filter.Match(object) {
+			continue
+		}
+		// the archive picked for a delivery is the one marked done
+		if filter.Delivery != nil {
+			name := filter.Delivery(object.Key)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+		}
+		if done[object.Key] {
+			continue
+		}
+		deliveries = append(deliveries, object)
+	}
+	return deliveries, nil
+}
+
+// Progress records the deliveries of a publisher's backfill that are done.
+type Progress struct {
+	db     *bolt.DB
+	bucket []byte
+
+	now func() time.Time
+}
+
+// NewProgress returns the progress of the publisher's backfill in db.
+func NewProgress(db *bolt.DB, publisher string) *Progress {
+	return &Progress{
+		db:     db,
+		bucket: []byte("backfill/" + publisher),
+		now:    time.Now,
+	}
+}
+
+// Done returns the keys of the deliveries that are done.
+func (p *Progress) Done() (map[string]bool, error) {
+
+	done := make(map[string]bool)
+	if p.db == nil {
+		return done, nil
+	}
+
+	err := p.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(p.bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			done[string(k)] = true
+			return nil
+		})
+	})
+	return done, err
+}
+
+// Mark records the delivery as done.
+func (p *Progress) Mark(key string) error {
+
+	if p.db == nil {
+		return ErrNoDB
+	}
+
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(p.bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(p.now().UTC().Format(time.RFC3339)))
+	})
+}
+
+// Reset forgets what was done, the next backfill starts over.
+func (p *Progress) Reset() error {
+
+	if p.db == nil {
+		return ErrNoDB
+	}
+
+	return p.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(p.bucket)
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
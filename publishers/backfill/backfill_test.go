@@ -0,0 +1,141 @@
+package backfill
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/services"
+)
+
+func TestDeliveries(t *testing.T) {
+
+	dir := t.TempDir()
+	for key, date := range map[string]string{
+		"files/oup/2015.zip":      "2015-06-01",
+		"files/oup/2016.zip":      "2016-06-01",
+		"files/oup/2017.zip":      "2017-06-01",
+		"files/oup/2017.txt":      "2017-06-01",
+		"files/bmj/2017.tar.gz":   "2017-06-01",
+		"files/oup/issues/1.zip":  "2018-06-01",
+		"files/oup/issues/2.zip":  "2019-06-01",
+		"files/oup/issues/readme": "2019-06-01",
+	} {
+		filename := filepath.Join(dir, "ftp", key)
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(key), 0666); err != nil {
+			t.Fatal(err)
+		}
+		modified, _ := time.Parse("2006-01-02", date)
+		if err := os.Chtimes(filename, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storage := services.NewFileStorage(dir)
+	progress := NewProgress(db, "oup")
+	since, _ := time.Parse("2006-01-02", "2016-01-01")
+	until, _ := time.Parse("2006-01-02", "2019-01-01")
+	filter := &Filter{Since: since, Until: until, Pattern: regexp.MustCompile(`\.zip$`)}
+
+	keys := func() []string {
+		deliveries, err := Deliveries(context.Background(), storage, "ftp", "oup", filter, progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, 0, len(deliveries))
+		for _, d := range deliveries {
+			keys = append(keys, d.Key)
+		}
+		return keys
+	}
+
+	expected := []string{"files/oup/2016.zip", "files/oup/2017.zip", "files/oup/issues/1.zip"}
+	if got := keys(); len(got) != 3 || got[0] != expected[0] || got[1] != expected[1] || got[2] != expected[2] {
+		t.Fatalf("expected %v got %v", expected, got)
+	}
+
+	if err := progress.Mark("files/oup/2016.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(); len(got) != 2 || got[0] != "files/oup/2017.zip" {
+		t.Errorf("expected the done delivery left out, got %v", got)
+	}
+
+	if err := progress.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(); len(got) != 3 {
+		t.Errorf("expected all deliveries after a reset, got %v", got)
+	}
+}
+
+func TestDeliveriesSplit(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, key := range []string{
+		"files/pnas/113_26/pnas_113_26.img.zip",
+		"files/pnas/113_26/pnas_113_26.pdf.zip",
+		"files/pnas/113_26/pnas_113_26.xml.zip",
+		"files/pnas/113_27/pnas_113_27.pdf.zip",
+		"files/pnas/113_27/pnas_113_27.xml.zip",
+	} {
+		filename := filepath.Join(dir, "ftp", key)
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(key), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storage := services.NewFileStorage(dir)
+	progress := NewProgress(db, "pnas")
+	filter := &Filter{Delivery: func(key string) string { return strings.SplitN(key, ".", 2)[0] }}
+
+	keys := func() []string {
+		deliveries, err := Deliveries(context.Background(), storage, "ftp", "pnas", filter, progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, 0, len(deliveries))
+		for _, d := range deliveries {
+			keys = append(keys, d.Key)
+		}
+		return keys
+	}
+
+	expected := []string{"files/pnas/113_26/pnas_113_26.img.zip", "files/pnas/113_27/pnas_113_27.pdf.zip"}
+	if got := keys(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v got %v", expected, got)
+	}
+
+	// the delivery is done once the archive picked for it is
+	if err := progress.Mark(expected[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(); !reflect.DeepEqual(got, expected[1:]) {
+		t.Errorf("expected the done delivery left out, got %v", got)
+	}
+}
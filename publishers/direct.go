@@ -0,0 +1,35 @@
+package publishers
+
+import (
+	"context"
+	"time"
+
+	"github.com/yewno/acquisition/services"
+)
+
+// NewDirectJob is the job of an archive processed directly, not received
+// from the new content queue.
+func NewDirectJob(bucket, key string, size int64) *Job {
+
+	record := services.SnsRecord{}
+	record.S3.Bucket.Name = bucket
+	record.S3.Object.Key = key
+	record.S3.Object.Size = size
+
+	message := &services.SnsMessage{Records: []services.SnsRecord{record}, Direct: true}
+	return &Job{Message: message, Attempts: 1, Direct: true}
+}
+
+// DirectQueue sends like the queue it wraps, but direct jobs weren't
+// received from it so there is no message to delete or hide.
+type DirectQueue struct {
+	services.CobaltQueue
+}
+
+func (q *DirectQueue) Pop(ctx context.Context, queue, receipt string) error {
+	return nil
+}
+
+func (q *DirectQueue) ExtendVisibility(ctx context.Context, queue, receipt string, timeout time.Duration) error {
+	return nil
+}
@@ -0,0 +1,193 @@
+package publishers
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+
+	"golang.org/x/net/html/charset"
+)
+
+const xlinkNamespace = "http://www.w3.org/1999/xlink"
+
+// JATS pairs a JATS article with the content its metadata points at through
+// <self-uri xlink:href>, <related-object xlink:href> or
+// <related-article xlink:href>, whatever the files are called. Articles
+// that don't reference a file in the archive, and files no article
+// references, are paired by Fallback. Pairs found through metadata have the
+// name of the metadata entry as their base.
+//
+// Disagreements between the metadata and the file names are reported
+// through Problems.
+type JATS struct {
+	// Meta are the extensions of the metadata files to read, .xml if empty.
+	Meta []string
+	// Content are the extensions of referenced files that count as content,
+	// .pdf if empty.
+	Content []string
+
+	Fallback Pairer
+
+	// refs maps the file name of referenced content to the metadata
+	// entries referencing it.
+	refs map[string][]string
+	// bases is the result of Prepare.
+	bases    map[string]string
+	problems []string
+}
+
+func (j *JATS) Inspects(name string) bool {
+	return hasExt(name, j.Meta, ".xml")
+}
+
+func (j *JATS) Inspect(name string, r io.Reader) error {
+
+	if j.refs == nil {
+		j.refs = make(map[string][]string, 100)
+	}
+
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charset.NewReaderLabel
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	for {
+		t, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		switch se := t.(type) {
+		case xml.StartElement:
+			switch se.Name.Local {
+			case "self-uri", "related-object", "related-article":
+			default:
+				continue
+			}
+
+			for _, attr := range se.Attr {
+				if attr.Name.Local != "href" || (attr.Name.Space != xlinkNamespace && attr.Name.Space != "xlink") {
+					continue
+				}
+
+				fn := hrefFilename(attr.Value)
+				if fn != "" && hasExt(fn, j.Content, ".pdf") && !contains(j.refs[fn], name) {
+					j.refs[fn] = append(j.refs[fn], name)
+				}
+			}
+
+		case xml.EndElement:
+			// everything we look for lives in the front matter
+			if se.Name.Local == "front" {
+				return nil
+			}
+		}
+	}
+}
+
+// Prepare pairs the referenced content with its metadata once every entry
+// of the archive is known.
+func (j *JATS) Prepare(items []Item) {
+
+	j.bases = make(map[string]string, len(items))
+	j.problems = j.problems[:0]
+
+	present := make(map[string]string, len(items))
+	for _, item := range items {
+		if item.Class == Content {
+			present[path.Base(item.Name)] = item.Name
+		}
+	}
+
+	referenced := make([]string, 0, len(j.refs))
+	for fn := range j.refs {
+		referenced = append(referenced, fn)
+	}
+	sort.Strings(referenced)
+
+	for _, fn := range referenced {
+		metas := j.refs[fn]
+
+		content, ok := present[fn]
+		if !ok {
+			for _, meta := range metas {
+				j.problems = append(j.problems, fmt.Sprintf("%s: references %s which is not in the archive", meta, fn))
+			}
+			continue
+		}
+
+		if len(metas) > 1 {
+			j.problems = append(j.problems, fmt.Sprintf("%s: referenced by %d articles %v", content, len(metas), metas))
+			continue
+		}
+		meta := metas[0]
+
+		metaBase, metaOk := j.fallback(meta)
+		contentBase, contentOk := j.fallback(content)
+		if !metaOk || !contentOk || metaBase != contentBase {
+			j.problems = append(j.problems, fmt.Sprintf("%s: metadata pairs it with %s, file names don't", content, meta))
+		}
+
+		// the metadata entry is unique in the archive where file name
+		// bases may not be
+		j.bases[meta] = meta
+		j.bases[content] = meta
+	}
+}
+
+func (j *JATS) Base(name string) (string, bool) {
+	if base, ok := j.bases[name]; ok {
+		return base, true
+	}
+	return j.fallback(name)
+}
+
+// Problems are the disagreements between metadata and file names found by
+// the last Prepare.
+func (j *JATS) Problems() []string {
+	return j.problems
+}
+
+func (j *JATS) fallback(name string) (string, bool) {
+	if j.Fallback == nil {
+		return "", false
+	}
+	return j.Fallback.Base(name)
+}
+
+// hrefFilename is the file name an xlink:href points at, for relative paths
+// as well as full urls.
+func hrefFilename(href string) string {
+	if u, err := url.Parse(href); err == nil && u.Path != "" {
+		href = u.Path
+	}
+	fn := path.Base(href)
+	if fn == "." || fn == "/" {
+		return ""
+	}
+	return fn
+}
+
+func hasExt(name string, exts []string, def string) bool {
+	ext := path.Ext(name)
+	if len(exts) == 0 {
+		return ext == def
+	}
+	return contains(exts, ext)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package publishers
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const jatsArticle = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE article PUBLIC "-//NLM//DTD JATS (Z39.96) Journal Publishing DTD v1.1 20151215//EN" "JATS-journalpublishing1.dtd">
+<article xmlns:xlink="http://www.w3.org/1999/xlink">
+  <front>
+    <article-meta>
+      <title-group><article-title>Caf&eacute; &amp; co</article-title></title-group>
+      <self-uri xlink:href="%s" content-type="pdf"/>
+    </article-meta>
+  </front>
+  <body><self-uri xlink:href="ignored.pdf"/></body>
+</article>`
+
+func inspect(t *testing.T, j *JATS, name, href string) {
+	if !j.Inspects(name) {
+		t.Fatalf("expected %s to be inspected", name)
+	}
+	if err := j.Inspect(name, strings.NewReader(strings.Replace(jatsArticle, "%s", href, 1))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJATS(t *testing.T) {
+
+	j := &JATS{Fallback: Basename{}}
+
+	// metadata names its pdf differently
+	inspect(t, j, "issue/bmj.i1.xml", "bmj_article_1_full.pdf")
+	// metadata names a pdf that wasn't delivered
+	inspect(t, j, "issue/bmj2.xml", "http://www.bmj.com/content/bmj2.full.pdf")
+	// metadata agrees with the file names
+	inspect(t, j, "issue/bmj3.xml", "bmj3.pdf")
+
+	if j.Inspects("issue/bmj3.pdf") {
+		t.Error("pdfs aren't metadata")
+	}
+
+	items := []Item{
+		{Name: "issue/bmj.i1.xml", Key: "bmj/issue/bmj.i1.xml.gz", Class: Meta},
+		{Name: "issue/bmj_article_1_full.pdf", Key: "bmj/issue/bmj_article_1_full.pdf", Class: Content},
+		{Name: "issue/bmj2.xml", Key: "bmj/issue/bmj2.xml.gz", Class: Meta},
+		{Name: "issue/bmj2.pdf", Key: "bmj/issue/bmj2.pdf", Class: Content},
+		{Name: "issue/bmj3.xml", Key: "bmj/issue/bmj3.xml.gz", Class: Meta},
+		{Name: "issue/bmj3.pdf", Key: "bmj/issue/bmj3.pdf", Class: Content},
+	}
+
+	pairs, unpaired := MakePairs(j, items)
+
+	expected := map[string]*Pair{
+		"issue/bmj.i1.xml": {Meta: "bmj/issue/bmj.i1.xml.gz", Content: "bmj/issue/bmj_article_1_full.pdf"},
+		"bmj2":             {Meta: "bmj/issue/bmj2.xml.gz", Content: "bmj/issue/bmj2.pdf"},
+		"issue/bmj3.xml":   {Meta: "bmj/issue/bmj3.xml.gz", Content: "bmj/issue/bmj3.pdf"},
+	}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+	if len(unpaired) != 0 {
+		t.Errorf("unexpected unpaired items %v", unpaired)
+	}
+
+	problems := j.Problems()
+	sort.Strings(problems)
+	expectedProblems := []string{
+		"issue/bmj2.xml: references bmj2.full.pdf which is not in the archive",
+		"issue/bmj_article_1_full.pdf: metadata pairs it with issue/bmj.i1.xml, file names don't",
+	}
+	if !reflect.DeepEqual(problems, expectedProblems) {
+		t.Errorf("unexpected problems %q", problems)
+	}
+}
+
+func TestJATSUnreferencedContent(t *testing.T) {
+
+	j := &JATS{Fallback: Basename{}}
+	inspect(t, j, "a.xml", "a_full.pdf")
+
+	items := []Item{
+		{Name: "a.xml", Key: "a.xml.gz", Class: Meta},
+		{Name: "a_full.pdf", Key: "a_full.pdf", Class: Content},
+		{Name: "a.pdf", Key: "a.pdf", Class: Content},
+	}
+
+	pairs, _ := MakePairs(j, items)
+	expected := map[string]*Pair{
+		"a.xml": {Meta: "a.xml.gz", Content: "a_full.pdf"},
+		"a":     {Content: "a.pdf"},
+	}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+}
+
+func TestJATSFallback(t *testing.T) {
+
+	j := &JATS{Fallback: Basename{}}
+	if err := j.Inspect("a.xml", strings.NewReader("<article><front/></article>")); err != nil {
+		t.Fatal(err)
+	}
+
+	pairs, _ := MakePairs(j, []Item{
+		{Name: "a.xml", Key: "a.xml.gz", Class: Meta},
+		{Name: "a.pdf", Key: "a.pdf", Class: Content},
+	})
+	if !reflect.DeepEqual(pairs, map[string]*Pair{"a": {Meta: "a.xml.gz", Content: "a.pdf"}}) {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+	if len(j.Problems()) != 0 {
+		t.Errorf("unexpected problems %v", j.Problems())
+	}
+}
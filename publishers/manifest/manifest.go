@@ -0,0 +1,191 @@
+// Package manifest records what became of an archive: every entry uploaded
+// from it, how it paired and the messages sent for it. Manifests are
+// written to the processed bucket next to the content so where an article
+// came from can be answered without the logs.
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/services"
+)
+
+// DefaultPrefix is where manifests go when the config doesn't say.
+const DefaultPrefix = "manifests"
+
+// Status of an entry as far as pairing goes.
+const (
+	Paired   = "paired"
+	Orphan   = "orphan"
+	Unpaired = "unpaired"
+	Attached = "attached"
+)
+
+// Manifest is the record of a delivery, a single archive for most
+// publishers.
+type Manifest struct {
+	Publisher string `json:"publisher"`
+	// Key is the key of the delivery, the manifest is saved under it.
+	Key      string     `json:"key"`
+	Archives []*Archive `json:"archives"`
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	Entries  []*Entry                `json:"entries"`
+	Messages []*services.PairMessage `json:"messages"`
+
+	byKey map[string]*Entry
+}
+
+// Archive is a delivered archive.
+type Archive struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	// SHA256 is the checksum of downloaded archives, ETag storage's own
+	// of archives read in place in storage.
+	SHA256 string `json:"sha256,omitempty"`
+	ETag   string `json:"etag,omitempty"`
+}
+
+// Entry is an uploaded archive entry.
+type Entry struct {
+	// Archive is the key of the archive the entry came from.
+	Archive string `json:"archive"`
+	// Name is the path of the entry inside the archive.
+	Name string `json:"name"`
+	// Key is where the entry was uploaded to.
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Class  string `json:"class"`
+	// Status is how the entry paired, empty for entries that don't pair.
+	Status string `json:"status,omitempty"`
+	// Unchanged is set when the upload was skipped.
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+// New starts the manifest of the delivery under key.
+func New(publisher, key string) *Manifest {
+	return &Manifest{
+		Publisher: publisher,
+		Key:       key,
+		Archives:  make([]*Archive, 0, 1),
+		Started:   time.Now().UTC(),
+		Entries:   make([]*Entry, 0, 100),
+		Messages:  make([]*services.PairMessage, 0, 100),
+		byKey:     make(map[string]*Entry, 100),
+	}
+}
+
+// Source records the size and checksum of a delivered archive, its SHA-256
+// when it was downloaded or the ETag from Head when it is read in place.
+func (m *Manifest) Source(object *services.Object) error {
+	archive := &Archive{
+		Bucket: object.Bucket,
+		Key:    object.Key,
+		Size:   object.Size,
+	}
+	m.Archives = append(m.Archives, archive)
+
+	if object.File == nil {
+		if object.ETag == "" {
+			return fmt.Errorf("manifest: no checksum of %s/%s", object.Bucket, object.Key)
+		}
+		archive.ETag = object.ETag
+		return nil
+	}
+	if err := object.Sum(); err != nil {
+		return err
+	}
+	archive.SHA256 = object.Hash
+	return nil
+}
+
+// Add records an entry of archive saved as object.
+func (m *Manifest) Add(archive, name string, object *services.Object, class publishers.Class) {
+	entry := &Entry{
+		Archive:   archive,
+		Name:      name,
+		Key:       object.Key,
+		Size:      object.Size,
+		SHA256:    object.Hash,
+		Class:     class.String(),
+		Unchanged: object.Unchanged,
+	}
+	m.Entries = append(m.Entries, entry)
+	m.byKey[entry.Key] = entry
+}
+
+// Pairs records how the entries paired.
+func (m *Manifest) Pairs(pairs map[string]*publishers.Pair, unpaired []publishers.Item) {
+
+	for _, p := range pairs {
+		status := Paired
+		if p.Meta == "" || p.Content == "" {
+			status = Orphan
+		}
+		m.status(p.Meta, status)
+		m.status(p.Content, status)
+	}
+
+	for _, item := range unpaired {
+		m.status(item.Key, Unpaired)
+	}
+}
+
+// Sent records a message sent for the delivery.
+func (m *Manifest) Sent(message *services.PairMessage) {
+	m.Messages = append(m.Messages, message)
+	for _, key := range message.Attachments {
+		m.status(key, Attached)
+	}
+}
+
+// Save writes the manifest to prefix/<delivery key>.json in bucket.
+func (m *Manifest) Save(ctx context.Context, conn services.CobaltStorage, bucket, prefix string) error {
+
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	m.Finished = time.Now().UTC()
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		return err
+	}
+
+	size, err := file.Write(b)
+	object := services.NewObject(file, bucket, path.Join(prefix, m.Key)+".json", int64(size))
+	defer object.Close()
+	if err != nil {
+		return err
+	}
+	object.Tags = map[string]string{
+		services.TagPublisher: m.Publisher,
+		services.TagArchive:   m.Key,
+		services.TagClass:     "manifest",
+	}
+
+	return object.Save(ctx, conn)
+}
+
+// status sets the status of the entry uploaded to key. Keys of other
+// archives, orphans paired up from earlier deliveries, are ignored.
+func (m *Manifest) status(key, status string) {
+	if entry, ok := m.byKey[key]; ok {
+		entry.Status = status
+	}
+}
@@ -0,0 +1,137 @@
+package manifest
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/services"
+)
+
+func saved(t *testing.T, dir, key, body string) *services.Object {
+
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(body)
+
+	object := services.NewObject(file, dir, key, int64(len(body)))
+	if err := object.Save(context.Background(), &publishers.MockStorage{}); err != nil {
+		t.Fatal(err)
+	}
+	object.Close()
+	return object
+}
+
+func TestManifest(t *testing.T) {
+
+	dir := t.TempDir()
+	conn := &publishers.MockStorage{}
+
+	delivered := filepath.Join(dir, "ftp", "files/bmj/1.zip")
+	if err := os.MkdirAll(filepath.Dir(delivered), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(delivered, []byte("zip"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	archive := services.NewObject(nil, filepath.Join(dir, "ftp"), "files/bmj/1.zip", 0)
+	if err := conn.Get(context.Background(), archive); err != nil {
+		t.Fatal(err)
+	}
+	defer archive.File.Close()
+
+	record := New("bmj", "files/bmj/1.zip")
+	if err := record.Source(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	record.Add("files/bmj/1.zip", "a.pdf", saved(t, dir, "bmj/a.pdf", "pdf"), publishers.Content)
+	record.Add("files/bmj/1.zip", "a.xml", saved(t, dir, "bmj/a.xml", "<article/>"), publishers.Meta)
+	record.Add("files/bmj/1.zip", "b.xml", saved(t, dir, "bmj/b.xml", "<article/>"), publishers.Meta)
+	record.Add("files/bmj/1.zip", "c.xml", saved(t, dir, "bmj/c.xml", "<article/>"), publishers.Meta)
+	record.Add("files/bmj/1.zip", "cover.jpg", saved(t, dir, "bmj/cover.jpg", "jpg"), publishers.Other)
+
+	record.Pairs(map[string]*publishers.Pair{
+		"a": {Meta: "bmj/a.xml.gz", Content: "bmj/a.pdf"},
+		"b": {Meta: "bmj/b.xml.gz"},
+	}, []publishers.Item{{Name: "c.xml", Key: "bmj/c.xml.gz", Class: publishers.Meta}})
+	record.Sent(&services.PairMessage{Source: "bmj", Key: "bmj/a.pdf", MetaKey: "bmj/a.xml.gz"})
+
+	if err := record.Save(context.Background(), conn, dir, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "manifests/files/bmj/1.zip.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Archives) != 1 || m.Archives[0].Size != 3 || len(m.Archives[0].SHA256) != 64 {
+		t.Errorf("unexpected archives %+v", m.Archives)
+	}
+	if m.Finished.Before(m.Started) {
+		t.Errorf("finished %v before started %v", m.Finished, m.Started)
+	}
+	if len(m.Messages) != 1 || m.Messages[0].MetaKey != "bmj/a.xml.gz" {
+		t.Errorf("unexpected messages %+v", m.Messages)
+	}
+
+	expected := map[string][2]string{
+		"bmj/a.pdf":     {"content", Paired},
+		"bmj/a.xml.gz":  {"meta", Paired},
+		"bmj/b.xml.gz":  {"meta", Orphan},
+		"bmj/c.xml.gz":  {"meta", Unpaired},
+		"bmj/cover.jpg": {"other", ""},
+	}
+	if len(m.Entries) != len(expected) {
+		t.Fatalf("unexpected entries %+v", m.Entries)
+	}
+	for _, entry := range m.Entries {
+		if got := [2]string{entry.Class, entry.Status}; got != expected[entry.Key] || entry.Archive != "files/bmj/1.zip" {
+			t.Errorf("%s: unexpected entry %+v", entry.Key, entry)
+		}
+	}
+}
+
+func TestSourceInPlace(t *testing.T) {
+
+	dir := t.TempDir()
+	conn := &publishers.MockStorage{}
+
+	delivered := filepath.Join(dir, "ftp", "files/pnas/1.xml.zip")
+	if err := os.MkdirAll(filepath.Dir(delivered), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(delivered, []byte("zip"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// read in place, the archive is only ever headed
+	archive := services.NewObject(nil, filepath.Join(dir, "ftp"), "files/pnas/1.xml.zip", 0)
+	if err := conn.Head(context.Background(), archive); err != nil {
+		t.Fatal(err)
+	}
+	record := New("pnas", "files/pnas/1")
+	if err := record.Source(archive); err != nil {
+		t.Fatal(err)
+	}
+	if a := record.Archives[0]; a.ETag != fmt.Sprintf("%x", md5.Sum([]byte("zip"))) || a.SHA256 != "" {
+		t.Errorf("unexpected archive %+v", a)
+	}
+
+	if err := record.Source(services.NewObject(nil, "ftp", "files/pnas/2.xml.zip", 3)); err == nil {
+		t.Error("expected an error for an archive without a checksum")
+	}
+}
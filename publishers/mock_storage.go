@@ -1,95 +1,121 @@
 package publishers
 
 import (
+	"context"
 	"encoding/json"
 	"io"
-	"io/ioutil"
-	"os"
-	"path"
+	"sync"
+	"time"
 
 	"github.com/yewno/acquisition/services"
 )
 
-type MockStorage struct{}
+// MockStorage is file storage rooted at the working directory, buckets
+// are given by their path. It counts the ranged reads.
+type MockStorage struct {
+	services.FileStorage
 
-func (z *MockStorage) Get(o *services.Object) error {
+	mu     sync.Mutex
+	Ranges int
+	// RangeErr makes ranged reads fail once RangeLimit of them were
+	// made.
+	RangeErr   error
+	RangeLimit int
 
-	p := path.Join(o.Bucket, o.Key)
-	file, err := os.Open(p)
-	if err != nil {
-		return err
-	}
-
-	o.File = file
-
-	stat, err := file.Stat()
-	if err != nil {
-		return err
-	}
-
-	o.Size = stat.Size()
-
-	return nil
+	// UploadErr makes every upload fail.
+	UploadErr error
 }
 
-func (z *MockStorage) Put(o *services.Object) error {
-
-	filepath := path.Join(o.Bucket, o.Key)
-
-	dir, _ := path.Split(filepath)
-	if err := os.MkdirAll(dir, 0777); err != nil {
-		return err
-	}
+func (z *MockStorage) Put(ctx context.Context, o *services.Object) error {
+	return z.Upload(ctx, o, o.File)
+}
 
-	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		return err
+func (z *MockStorage) Upload(ctx context.Context, o *services.Object, body io.Reader) error {
+	if z.UploadErr != nil {
+		return z.UploadErr
 	}
-	defer file.Close()
+	return z.FileStorage.Upload(ctx, o, body)
+}
 
-	_, err = io.Copy(file, o.File)
-	if err != nil {
-		return err
+func (z *MockStorage) GetRange(ctx context.Context, o *services.Object, offset, length int64) (io.ReadCloser, error) {
+	z.mu.Lock()
+	if z.RangeErr != nil && z.Ranges >= z.RangeLimit {
+		z.mu.Unlock()
+		return nil, z.RangeErr
 	}
-	return nil
+	z.Ranges++
+	z.mu.Unlock()
+	return z.FileStorage.GetRange(ctx, o, offset, length)
 }
 
 type MockQueue struct {
 	Messages []string
+
+	// Popped are the receipts of deleted messages, Visibility the last
+	// timeout set per receipt.
+	Popped     []string
+	Visibility map[string]time.Duration
+
+	// SendErr makes every batch fail to send, AddErr fail to take
+	// messages, PopErr every delete fail.
+	SendErr error
+	AddErr  error
+	PopErr  error
 }
 
-func (z *MockQueue) Poll(queue string, amount int) chan *services.Message {
+func (z *MockQueue) Poll(ctx context.Context, queue string, amount int) chan *services.Message {
 	return nil
 }
 
-func (z *MockQueue) Pop(queue, receipt string) error {
+func (z *MockQueue) Pop(ctx context.Context, queue, receipt string) error {
+	if z.PopErr != nil {
+		return z.PopErr
+	}
+	z.Popped = append(z.Popped, receipt)
+	return nil
+}
+
+func (z *MockQueue) ExtendVisibility(ctx context.Context, queue, receipt string, timeout time.Duration) error {
+	if z.Visibility == nil {
+		z.Visibility = make(map[string]time.Duration, 10)
+	}
+	z.Visibility[receipt] = timeout
 	return nil
 }
 
-func (z *MockQueue) NewBatch(queue string) services.CobaltQueueBatch {
+func (z *MockQueue) NewBatch(ctx context.Context, queue string) services.CobaltQueueBatch {
 	return &MockBatch{
 		Queue: z,
 	}
 }
 
 type MockBatch struct {
-	Queue *MockQueue
+	Queue    *MockQueue
+	messages []string
 }
 
 func (z *MockBatch) Add(m interface{}) error {
 
+	if z.Queue.AddErr != nil {
+		return z.Queue.AddErr
+	}
+
 	body, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
 
-	z.Queue.Messages = append(z.Queue.Messages, string(body))
+	z.messages = append(z.messages, string(body))
 	return nil
 }
 
-func (z *MockBatch) Flush() {
+func (z *MockBatch) Flush() error {
 
-	return
+	if z.Queue.SendErr != nil {
+		return z.Queue.SendErr
+	}
+	z.Queue.Messages = append(z.Queue.Messages, z.messages...)
+	return nil
 }
 
 type Pair struct {
@@ -97,16 +123,23 @@ type Pair struct {
 	Content string
 }
 
-func ArchiveEntryToFile(reader io.Reader) (*os.File, int64, error) {
+// Class is what an archive entry is as far as pairing is concerned.
+type Class int
 
-	temp, err := ioutil.TempFile("", "")
-	if err != nil {
-		return nil, -1, err
-	}
+const (
+	Other Class = iota
+	Content
+	Meta
+)
 
-	size, err := io.Copy(temp, reader)
-	_, err = temp.Seek(0, 0)
-	return temp, size, err
+func (c Class) String() string {
+	switch c {
+	case Content:
+		return "content"
+	case Meta:
+		return "meta"
+	}
+	return "other"
 }
 
 type Stats struct {
@@ -119,6 +152,13 @@ type Stats struct {
 	Pairs          chan int
 	MissingMeta    chan int
 	MissingContent chan int
+	// Unmatched counts orphans that gave up waiting for their partner.
+	Unmatched chan int
+
+	// Skipped counts uploads skipped because the content didn't change,
+	// SkippedPairs the pairs not announced again because of it.
+	Skipped      chan int
+	SkippedPairs chan int
 
 	ProblemFilenames chan string
 	Report           chan string
@@ -133,6 +173,9 @@ func NewStats() *Stats {
 		Pairs:            make(chan int, 100),
 		MissingMeta:      make(chan int, 100),
 		MissingContent:   make(chan int, 100),
+		Unmatched:        make(chan int, 100),
+		Skipped:          make(chan int, 100),
+		SkippedPairs:     make(chan int, 100),
 		ProblemFilenames: make(chan string, 100),
 		Report:           make(chan string, 100),
 	}
@@ -1,16 +1,17 @@
 package nas
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"path"
 	"strings"
-	"sync"
 
 	"github.com/yewno/acquisition/config"
 	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/publishers/manifest"
 	"github.com/yewno/acquisition/services"
 )
 
@@ -27,41 +28,48 @@ type Object struct {
 	conn  services.CobaltStorage
 	queue services.CobaltQueue
 	cfg   *config.Config
-	wg    *sync.WaitGroup
-	pool  chan bool
 
 	stats *publishers.Stats
 }
 
-func NewObject(conn services.CobaltStorage, queue services.CobaltQueue, wg *sync.WaitGroup, cfg *config.Config, pool chan bool, stats *publishers.Stats) *Object {
-	wg.Add(1)
+func init() {
+	publishers.Register("nas", NewObject)
+}
+
+func NewObject(env *publishers.Env) publishers.Processor {
 	return &Object{
-		conn:  conn,
-		queue: queue,
-		wg:    wg,
-		cfg:   cfg,
-		pool:  pool,
+		conn:  env.Storage,
+		queue: env.Queue,
+		cfg:   env.Config,
 
-		stats: stats,
+		stats: env.Stats,
 	}
 }
 
-func (o *Object) Process(receipt string, message *services.SnsMessage) error {
+func (o *Object) Process(ctx context.Context, job *publishers.Job) publishers.Result {
+	count, err := o.process(ctx, job)
+	return publishers.Result{Publisher: "nas", Pairs: count, Err: err}
+}
 
-	defer o.wg.Done()
-	defer func() { <-o.pool }()
+func (o *Object) process(ctx context.Context, job *publishers.Job) (int, error) {
 
 	var (
-		bucket = message.Records[0].S3.Bucket.Name
-		key    = message.Records[0].S3.Object.Key
-		size   = message.Records[0].S3.Object.Size
-		pairs  = make([]string, 0, 100)
+		bucket = job.Bucket()
+		key    = job.Key()
+		size   = job.Size()
+		pairs  = make([]*services.PairMessage, 0, 100)
+		count  int
 	)
 
 	object := services.NewObject(nil, bucket, key, size)
-	err := o.conn.Get(object)
+	err := o.conn.Get(ctx, object)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	delivery := manifest.New("nas", key)
+	if err := delivery.Source(object); err != nil {
+		log.Println(err)
 	}
 
 	ext := path.Ext(key)
@@ -70,8 +78,21 @@ func (o *Object) Process(receipt string, message *services.SnsMessage) error {
 	case ".pdf":
 		key = strings.TrimPrefix(key, "files/")
 		pdfObject := services.NewObject(object.File, o.cfg.ProcessedBucket, key, object.Size)
-		err = pdfObject.Save(o.conn)
+		pdfObject.Compression = publishers.Compression(o.cfg, "nas", nil)
+		pdfObject.Tags = publishers.Tags("nas", job.Key(), publishers.Content)
+		err = pdfObject.Save(ctx, o.conn)
 		pdfObject.Close()
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err != nil {
+			log.Println(err)
+			return 0, err
+		}
+		if pdfObject.Unchanged {
+			o.stats.Skipped <- 1
+		}
+		delivery.Add(job.Key(), path.Base(key), pdfObject, publishers.Content)
 	case ".xml":
 		decoder := xml.NewDecoder(object.File)
 		for {
@@ -90,7 +111,7 @@ func (o *Object) Process(receipt string, message *services.SnsMessage) error {
 
 					if err != nil {
 						log.Println(err)
-						return err
+						return 0, err
 					}
 
 					var bookId string
@@ -108,7 +129,7 @@ func (o *Object) Process(receipt string, message *services.SnsMessage) error {
 
 					bytesArr, err := xml.Marshal(&record)
 					if err != nil {
-						return err
+						return 0, err
 					}
 
 					tf, err := ioutil.TempFile("", "")
@@ -124,35 +145,66 @@ func (o *Object) Process(receipt string, message *services.SnsMessage) error {
 					}
 
 					object := services.NewObject(tf, o.cfg.ProcessedBucket, key, int64(size))
-					err = object.Save(o.conn)
+					object.Compression = publishers.Compression(o.cfg, "nas", nil)
+					object.Tags = publishers.Tags("nas", job.Key(), publishers.Meta)
+					err = object.Save(ctx, o.conn)
 					object.Close()
+					if ctx.Err() != nil {
+						return 0, ctx.Err()
+					}
+					if err != nil {
+						// a pair can't point at meta that isn't stored
+						log.Println(err)
+						return 0, err
+					}
+					if object.Unchanged {
+						o.stats.Skipped <- 1
+					}
+					delivery.Add(job.Key(), key, object, publishers.Meta)
 
-					pairs = append(pairs, object.Key)
+					pairs = append(pairs, &services.PairMessage{
+						Source:  "nas",
+						Bucket:  o.cfg.ProcessedBucket,
+						Key:     fmt.Sprintf("nas/%s.pdf", bookId),
+						MetaKey: object.Key,
+					})
 
 				}
 			}
 		}
-		batch := o.queue.NewBatch(o.cfg.ProcessedQueue)
-		count := 0
-		for _, meta := range pairs {
-			count++
-			content := fmt.Sprintf("%s.pdf", strings.TrimSuffix(meta, ".xml.gz"))
-			m := &services.PairMessage{
-				Source:  "nas",
-				Bucket:  o.cfg.ProcessedBucket,
-				Key:     content,
-				MetaKey: meta,
+		var sendErr error
+		batch := o.queue.NewBatch(ctx, o.cfg.ProcessedQueue)
+		for _, m := range pairs {
+			if err := batch.Add(m); err != nil {
+				log.Println(err)
+				sendErr = err
+				continue
 			}
+			count++
 			o.stats.Pairs <- 1
-			batch.Add(m)
+			delivery.Sent(m)
 		}
 		o.stats.Report <- fmt.Sprintf("nas:%d", count)
-		batch.Flush()
+		if err := batch.Flush(); err != nil {
+			// the message isn't deleted, it comes back to send the pairs again
+			log.Println(err)
+			return count, err
+		}
+		if sendErr != nil {
+			return count, sendErr
+		}
+	}
+	if ctx.Err() != nil {
+		return count, ctx.Err()
+	}
+
+	if err := delivery.Save(ctx, o.conn, o.cfg.ProcessedBucket, o.cfg.ManifestPrefix); err != nil {
+		log.Println(err)
 	}
 
-	if err := o.queue.Pop(o.cfg.NewContentQueue, receipt); err != nil {
+	if err := o.queue.Pop(ctx, o.cfg.NewContentQueue, job.Receipt); err != nil {
 		log.Println(err)
-		return err
+		return count, err
 	}
-	return nil
+	return count, nil
 }
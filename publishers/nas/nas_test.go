@@ -0,0 +1,78 @@
+package nas
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yewno/acquisition/config"
+	"github.com/yewno/acquisition/publishers"
+)
+
+const onix = `<ONIXMessage>
+<Product>
+<ProductIdentifier><ProductIDType>15</ProductIDType><IDValue>9780309000001</IDValue></ProductIdentifier>
+</Product>
+</ONIXMessage>`
+
+// process runs the job of the delivery key, uploading to storage.
+func process(t *testing.T, storage *publishers.MockStorage, key string) (*publishers.MockQueue, publishers.Result) {
+
+	dir := t.TempDir()
+	ftp := filepath.Join(dir, "ftp")
+
+	filename := filepath.Join(ftp, key)
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		t.Fatal(err)
+	}
+	body := "%PDF"
+	if filepath.Ext(key) == ".xml" {
+		body = onix
+	}
+	if err := ioutil.WriteFile(filename, []byte(body), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := &publishers.MockQueue{}
+	obj := NewObject(&publishers.Env{
+		Storage: storage,
+		Queue:   queue,
+		Config: &config.Config{
+			ProcessedBucket: filepath.Join(dir, "processed"),
+			ProcessedQueue:  "processQueue",
+			NewContentQueue: "newContentQueue",
+		},
+		Stats: publishers.NewStats(),
+	})
+
+	job := publishers.NewJob("foo", publishers.NewDirectJob(ftp, key, int64(len(body))).Message)
+	return queue, obj.Process(context.Background(), job)
+}
+
+func TestProcess(t *testing.T) {
+
+	queue, result := process(t, &publishers.MockStorage{}, "files/nas/onix.xml")
+	if result.Err != nil || result.Pairs != 1 {
+		t.Fatalf("unexpected result %v", result)
+	}
+	if len(queue.Messages) != 1 || len(queue.Popped) != 1 {
+		t.Errorf("unexpected messages %v, popped %v", queue.Messages, queue.Popped)
+	}
+}
+
+func TestProcessUploadFailure(t *testing.T) {
+
+	// neither the book nor its meta can be stored
+	for _, key := range []string{"files/nas/9780309000001.pdf", "files/nas/onix.xml"} {
+		queue, result := process(t, &publishers.MockStorage{UploadErr: errors.New("s3 unavailable")}, key)
+		if result.Err == nil {
+			t.Errorf("%s: expected the upload failure", key)
+		}
+		if len(queue.Messages) != 0 || len(queue.Popped) != 0 {
+			t.Errorf("%s: pair announced or message deleted without its files stored: %v %v", key, queue.Messages, queue.Popped)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package publishers
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/yewno/acquisition/publishers/archive"
+	"github.com/yewno/acquisition/services"
+)
+
+// OpenArchive returns a reader over the entries of the archive object. Zip
+// archives are read in place with ranged reads, fetching only the directory
+// and the entries. Other formats are downloaded to object.File first,
+// closing the object removes the download.
+func OpenArchive(ctx context.Context, conn services.CobaltStorage, object *services.Object) (archive.Reader, error) {
+
+	if err := conn.Head(ctx, object); err != nil {
+		return nil, err
+	}
+
+	zipped, err := isZip(ctx, conn, object)
+	if err != nil {
+		return nil, err
+	}
+	if zipped {
+		return archive.Open(services.NewRangeReader(ctx, conn, object), object.Size, object.Key)
+	}
+
+	if err := conn.Get(ctx, object); err != nil {
+		return nil, err
+	}
+	return archive.Open(object.File, object.Size, object.Key)
+}
+
+// isZip reads the first bytes of the object to tell whether it is a zip
+// archive.
+func isZip(ctx context.Context, conn services.CobaltStorage, object *services.Object) (bool, error) {
+
+	const magic = 4
+	if object.Size < magic {
+		return false, nil
+	}
+
+	body, err := conn.GetRange(ctx, object, 0, magic)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	header, err := ioutil.ReadAll(io.LimitReader(body, magic))
+	if err != nil {
+		return false, err
+	}
+	return archive.Detect(header) == archive.Zip, nil
+}
@@ -0,0 +1,258 @@
+// Package orphans remembers the halves of pairs an archive delivered without
+// their partner. Publishers often send the missing half in a later delivery,
+// the ledger pairs it up when that delivery is processed.
+package orphans
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/publishers"
+)
+
+// ErrNoDB is returned when the ledger has no state database to write to.
+var ErrNoDB = errors.New("orphans: no state database")
+
+// DefaultAge is how long orphans wait for their partner when the config
+// doesn't say.
+const DefaultAge = 30 * 24 * time.Hour
+
+// Orphan is the half of a pair that arrived alone.
+type Orphan struct {
+	// Key is where the orphan was uploaded to.
+	Key string `json:"key"`
+	// Base is what the orphan pairs on.
+	Base string `json:"base"`
+	// Archive is the delivery the orphan came in.
+	Archive string `json:"archive"`
+
+	Publisher string           `json:"publisher"`
+	Class     publishers.Class `json:"class"`
+	Found     time.Time        `json:"found"`
+}
+
+// halves are the orphans of a base, at most one of each class.
+type halves struct {
+	Meta    *Orphan `json:"meta,omitempty"`
+	Content *Orphan `json:"content,omitempty"`
+}
+
+// Ledger holds the orphans of a publisher.
+type Ledger struct {
+	db        *bolt.DB
+	bucket    []byte
+	publisher string
+
+	now func() time.Time
+}
+
+// New returns the ledger of the publisher in db.
+func New(db *bolt.DB, publisher string) *Ledger {
+	return &Ledger{
+		db:        db,
+		bucket:    []byte("orphans/" + publisher),
+		publisher: publisher,
+		now:       time.Now,
+	}
+}
+
+// Match completes the incomplete pairs of an archive with the orphans
+// earlier archives left behind, in place, and returns how many it
+// completed. Halves still without a partner are recorded as orphans of
+// archive. The orphans it pairs up stay in the ledger until they are
+// Released, so they are still there if sending the pairs fails.
+func (l *Ledger) Match(archive string, pairs map[string]*publishers.Pair) (int, error) {
+
+	incomplete := make(map[string]*publishers.Pair, 0)
+	for base, p := range pairs {
+		if (p.Meta == "") != (p.Content == "") {
+			incomplete[base] = p
+		}
+	}
+	if len(incomplete) == 0 {
+		return 0, nil
+	}
+
+	if l.db == nil {
+		return 0, ErrNoDB
+	}
+
+	matched := 0
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(l.bucket)
+		if err != nil {
+			return err
+		}
+
+		for base, p := range incomplete {
+			h := &halves{}
+			if v := b.Get([]byte(base)); v != nil {
+				if err := json.Unmarshal(v, h); err != nil {
+					return err
+				}
+			}
+
+			switch {
+			case p.Meta == "" && h.Meta != nil:
+				p.Meta = h.Meta.Key
+				matched++
+				continue
+			case p.Content == "" && h.Content != nil:
+				p.Content = h.Content.Key
+				matched++
+				continue
+			case p.Meta == "":
+				h.Content = l.orphan(p.Content, base, archive, publishers.Content)
+			default:
+				h.Meta = l.orphan(p.Meta, base, archive, publishers.Meta)
+			}
+
+			if err := put(b, base, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return matched, nil
+}
+
+// Release forgets the orphans that are halves of the complete pairs, once
+// the pairs are sent.
+func (l *Ledger) Release(pairs map[string]*publishers.Pair) error {
+
+	if l.db == nil {
+		return nil
+	}
+
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(l.bucket)
+		if b == nil {
+			return nil
+		}
+
+		for base, p := range pairs {
+			if p.Meta == "" || p.Content == "" {
+				continue
+			}
+			v := b.Get([]byte(base))
+			if v == nil {
+				continue
+			}
+			h := &halves{}
+			if err := json.Unmarshal(v, h); err != nil {
+				return err
+			}
+			if h.Meta != nil && h.Meta.Key == p.Meta {
+				h.Meta = nil
+			}
+			if h.Content != nil && h.Content.Key == p.Content {
+				h.Content = nil
+			}
+			if err := put(b, base, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Expired removes and returns the orphans found longer than age ago.
+func (l *Ledger) Expired(age time.Duration) ([]*Orphan, error) {
+
+	if l.db == nil {
+		return nil, ErrNoDB
+	}
+
+	deadline := l.now().Add(-age)
+	expired := make([]*Orphan, 0)
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(l.bucket)
+		if b == nil {
+			return nil
+		}
+
+		changed := make(map[string]*halves)
+		err := b.ForEach(func(k, v []byte) error {
+			h := &halves{}
+			if err := json.Unmarshal(v, h); err != nil {
+				return err
+			}
+
+			if h.Meta != nil && h.Meta.Found.Before(deadline) {
+				expired = append(expired, h.Meta)
+				h.Meta = nil
+				changed[string(k)] = h
+			}
+			if h.Content != nil && h.Content.Found.Before(deadline) {
+				expired = append(expired, h.Content)
+				h.Content = nil
+				changed[string(k)] = h
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for base, h := range changed {
+			if err := put(b, base, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// Sweep reports the orphans older than age as unmatched and forgets them.
+func (l *Ledger) Sweep(age time.Duration, stats *publishers.Stats) error {
+
+	if age <= 0 {
+		age = DefaultAge
+	}
+
+	expired, err := l.Expired(age)
+	if err != nil {
+		return err
+	}
+
+	for _, orphan := range expired {
+		stats.Unmatched <- 1
+		stats.ProblemFilenames <- fmt.Sprintf("%s/%s: unmatched since %s", orphan.Archive, orphan.Key, orphan.Found.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (l *Ledger) orphan(key, base, archive string, class publishers.Class) *Orphan {
+	return &Orphan{
+		Key:       key,
+		Publisher: l.publisher,
+		Base:      base,
+		Archive:   archive,
+		Class:     class,
+		Found:     l.now(),
+	}
+}
+
+func put(b *bolt.Bucket, base string, h *halves) error {
+
+	if h.Meta == nil && h.Content == nil {
+		return b.Delete([]byte(base))
+	}
+
+	v, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(base), v)
+}
@@ -0,0 +1,124 @@
+package orphans
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/publishers"
+)
+
+func openDB(t *testing.T) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMatch(t *testing.T) {
+
+	ledger := New(openDB(t), "oup")
+
+	first := map[string]*publishers.Pair{
+		"a": {Meta: "oup/1-a.xml.gz"},
+		"b": {Content: "oup/1-b.pdf"},
+		"c": {Meta: "oup/1-c.xml.gz", Content: "oup/1-c.pdf"},
+	}
+	matched, err := ledger.Match("files/oup/1.zip", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched != 0 {
+		t.Errorf("matched %d pairs of the first archive", matched)
+	}
+
+	second := map[string]*publishers.Pair{
+		"a": {Content: "oup/2-a.pdf"},
+		"b": {Content: "oup/2-b.pdf"},
+	}
+	matched, err = ledger.Match("files/oup/2.zip", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched != 1 {
+		t.Errorf("expected 1 match, got %d", matched)
+	}
+
+	expected := map[string]*publishers.Pair{
+		"a": {Meta: "oup/1-a.xml.gz", Content: "oup/2-a.pdf"},
+		"b": {Content: "oup/2-b.pdf"},
+	}
+	if !reflect.DeepEqual(second, expected) {
+		t.Errorf("unexpected pairs %v", second)
+	}
+
+	// a stays until its pair is sent, in case sending fails
+	if matched, _ = ledger.Match("files/oup/2.zip", map[string]*publishers.Pair{"a": {Content: "oup/2-a.pdf"}}); matched != 1 {
+		t.Errorf("orphan gone before its pair was sent")
+	}
+
+	// a is paired and gone once released, b is remembered from the
+	// latest archive
+	if err := ledger.Release(second); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := ledger.Expired(-time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 {
+		t.Fatalf("unexpected orphans %v", expired)
+	}
+	orphan := expired[0]
+	if orphan.Key != "oup/2-b.pdf" || orphan.Base != "b" || orphan.Archive != "files/oup/2.zip" ||
+		orphan.Publisher != "oup" || orphan.Class != publishers.Content {
+		t.Errorf("unexpected orphan %+v", orphan)
+	}
+}
+
+func TestSweep(t *testing.T) {
+
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	ledger := New(openDB(t), "oup")
+	ledger.now = func() time.Time { return now }
+
+	ledger.Match("files/oup/1.zip", map[string]*publishers.Pair{"a": {Meta: "oup/1-a.xml.gz"}})
+	now = now.Add(48 * time.Hour)
+	ledger.Match("files/oup/2.zip", map[string]*publishers.Pair{"a": {Meta: "oup/2-a.xml.gz"}, "b": {Meta: "oup/2-b.xml.gz"}})
+
+	stats := publishers.NewStats()
+	if err := ledger.Sweep(24*time.Hour, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	// the redelivered a started waiting again
+	select {
+	case problem := <-stats.ProblemFilenames:
+		t.Errorf("unexpected problem %s", problem)
+	default:
+	}
+
+	now = now.Add(48 * time.Hour)
+	if err := ledger.Sweep(24*time.Hour, stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Unmatched) != 2 || len(stats.ProblemFilenames) != 2 {
+		t.Errorf("expected 2 unmatched orphans, got %d", len(stats.Unmatched))
+	}
+}
+
+func TestMatchComplete(t *testing.T) {
+
+	// archives without orphans don't need the state database
+	ledger := New(nil, "oup")
+	if _, err := ledger.Match("files/oup/1.zip", map[string]*publishers.Pair{"a": {Meta: "a.xml", Content: "a.pdf"}}); err != nil {
+		t.Error(err)
+	}
+	if _, err := ledger.Match("files/oup/1.zip", map[string]*publishers.Pair{"a": {Meta: "a.xml"}}); err != ErrNoDB {
+		t.Errorf("expected ErrNoDB, got %v", err)
+	}
+}
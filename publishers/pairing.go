@@ -0,0 +1,246 @@
+package publishers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Pairer decides which base an archive entry pairs on. Content and meta
+// entries with the same base make a pair.
+type Pairer interface {
+	// Base returns the base of the entry name, false if the rule can't
+	// be applied to it.
+	Base(name string) (string, bool)
+}
+
+// Inspector is implemented by pairers that need the content of some
+// entries, not only their names. Processors hand every entry the inspector
+// asks for to Inspect before pairing.
+type Inspector interface {
+	Inspects(name string) bool
+	Inspect(name string, r io.Reader) error
+}
+
+// Inspect hands the entry to the inspector if it asks for it and returns a
+// reader over the entry for the upload. Inspected entries, metadata small
+// enough for memory, are read once for both.
+func Inspect(inspector Inspector, name string, entry io.Reader) (io.Reader, error) {
+
+	if inspector == nil || !inspector.Inspects(name) {
+		return entry, nil
+	}
+
+	b, err := ioutil.ReadAll(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := inspector.Inspect(name, bytes.NewReader(b)); err != nil {
+		log.Println(err)
+	}
+	return bytes.NewReader(b), nil
+}
+
+// Preparer is implemented by pairers that need to see every item of the
+// archive before pairing any of them. MakePairs calls Prepare first.
+type Preparer interface {
+	Prepare(items []Item)
+}
+
+// Reporter is implemented by pairers that notice problems with an archive
+// while pairing it. Processors pass them on as problem filenames.
+type Reporter interface {
+	Problems() []string
+}
+
+// Basename pairs on the file name without its extension, so bmj.i123.pdf
+// and bmj.i123.xml share the base bmj.i123.
+type Basename struct{}
+
+func (Basename) Base(name string) (string, bool) {
+	fn := path.Base(name)
+	return strings.TrimSuffix(fn, path.Ext(fn)), true
+}
+
+// Prefix pairs on the first Length characters of the file name. Cambridge
+// names both halves of an article after a 17 character id followed by
+// anything.
+type Prefix struct {
+	Length int
+}
+
+func (p Prefix) Base(name string) (string, bool) {
+	fn := path.Base(name)
+	if p.Length <= 0 || len(fn) < p.Length {
+		return "", false
+	}
+	return fn[:p.Length], true
+}
+
+// Directory pairs on an element of the entry path, counted from the root of
+// the archive. A negative Segment counts back from the file name, -1 is the
+// directory holding the file.
+type Directory struct {
+	Segment int
+}
+
+func (d Directory) Base(name string) (string, bool) {
+	parts := strings.Split(name, "/")
+
+	i := d.Segment
+	if i < 0 {
+		i = len(parts) - 1 + i
+	}
+	if i < 0 || i >= len(parts)-1 {
+		return "", false
+	}
+	return parts[i], true
+}
+
+// Regex pairs on the first capture group of a pattern matched against the
+// entry path.
+type Regex struct {
+	Pattern *regexp.Regexp
+}
+
+// NewRegex compiles expr into a Regex pairer. expr needs a capture group.
+func NewRegex(expr string) (*Regex, error) {
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if pattern.NumSubexp() < 1 {
+		return nil, fmt.Errorf("pairing pattern (%s) has no capture group", expr)
+	}
+	return &Regex{Pattern: pattern}, nil
+}
+
+func (r *Regex) Base(name string) (string, bool) {
+	match := r.Pattern.FindStringSubmatch(name)
+	if len(match) < 2 || match[1] == "" {
+		return "", false
+	}
+	return match[1], true
+}
+
+// Manifest pairs entries the way a manifest shipped inside the archive says
+// they pair. The manifest is a csv file where every row is a base followed
+// by the file names that belong to it:
+//
+//	10.1093/abc123,abc123.pdf,abc123_meta.xml
+//
+// Entries missing from the manifest fall back to Fallback, if set.
+type Manifest struct {
+	Filename string
+	Fallback Pairer
+
+	bases map[string]string
+}
+
+func (m *Manifest) Inspects(name string) bool {
+	return path.Base(name) == m.Filename
+}
+
+func (m *Manifest) Inspect(name string, r io.Reader) error {
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	if m.bases == nil {
+		m.bases = make(map[string]string, 100)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		for _, fn := range record[1:] {
+			m.bases[path.Base(fn)] = record[0]
+		}
+	}
+}
+
+func (m *Manifest) Base(name string) (string, bool) {
+	if base, ok := m.bases[path.Base(name)]; ok {
+		return base, true
+	}
+	if m.Fallback != nil {
+		return m.Fallback.Base(name)
+	}
+	return "", false
+}
+
+// Item is an uploaded archive entry waiting to be paired.
+type Item struct {
+	// Name is the path of the entry inside the archive.
+	Name string
+	// Key is where the entry was uploaded to.
+	Key   string
+	Class Class
+	// Unchanged is set when storage already held the same content and
+	// the upload was skipped.
+	Unchanged bool
+}
+
+// Unchanged returns the keys of the items whose upload was skipped. A pair
+// with both halves in it was announced when they were first uploaded.
+func Unchanged(items []Item) map[string]bool {
+	unchanged := make(map[string]bool, len(items))
+	for _, item := range items {
+		if item.Unchanged {
+			unchanged[item.Key] = true
+		}
+	}
+	return unchanged
+}
+
+// MakePairs groups the content and meta items by the base the pairer gives
+// them. Content and meta items the pairer can't place are returned apart.
+func MakePairs(pairer Pairer, items []Item) (map[string]*Pair, []Item) {
+
+	if preparer, ok := pairer.(Preparer); ok {
+		preparer.Prepare(items)
+	}
+
+	pairs := make(map[string]*Pair, len(items)/2)
+	unpaired := make([]Item, 0)
+
+	for _, item := range items {
+
+		if item.Class == Other {
+			continue
+		}
+
+		base, ok := pairer.Base(item.Name)
+		if !ok {
+			unpaired = append(unpaired, item)
+			continue
+		}
+
+		pair, ok := pairs[base]
+		if !ok {
+			pair = &Pair{}
+			pairs[base] = pair
+		}
+
+		switch item.Class {
+		case Content:
+			pair.Content = item.Key
+		case Meta:
+			pair.Meta = item.Key
+		}
+	}
+	return pairs, unpaired
+}
@@ -0,0 +1,128 @@
+package publishers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type pairerCase struct {
+	name string
+	base string
+	ok   bool
+}
+
+func testPairer(t *testing.T, pairer Pairer, cases []pairerCase) {
+	for _, c := range cases {
+		base, ok := pairer.Base(c.name)
+		if base != c.base || ok != c.ok {
+			t.Errorf("%T %s: expected (%s, %v) got (%s, %v)", pairer, c.name, c.base, c.ok, base, ok)
+		}
+	}
+}
+
+func TestBasename(t *testing.T) {
+	testPairer(t, Basename{}, []pairerCase{
+		{"bmj.i123.pdf", "bmj.i123", true},
+		{"bmj.i456.xml", "bmj.i456", true},
+		{"issue/article-1.xml", "article-1", true},
+		{"noext", "noext", true},
+	})
+}
+
+func TestPrefix(t *testing.T) {
+	testPairer(t, Prefix{Length: 17}, []pairerCase{
+		{"issue/S0022112016001234a.pdf", "S0022112016001234", true},
+		{"issue/S0022112016001234.xml", "S0022112016001234", true},
+		{"issue/short.pdf", "", false},
+	})
+	testPairer(t, Prefix{}, []pairerCase{
+		{"anything.pdf", "", false},
+	})
+}
+
+func TestDirectory(t *testing.T) {
+	testPairer(t, Directory{Segment: 1}, []pairerCase{
+		{"issue/10.1080.123/article.pdf", "10.1080.123", true},
+		{"issue/10.1080.123/figs/f1.jpg", "10.1080.123", true},
+		{"issue/article.pdf", "", false},
+	})
+	testPairer(t, Directory{Segment: -1}, []pairerCase{
+		{"issue/10.1080.123/article.pdf", "10.1080.123", true},
+		{"issue/article.pdf", "issue", true},
+		{"article.pdf", "", false},
+	})
+}
+
+func TestRegex(t *testing.T) {
+
+	pairer, err := NewRegex(`^(.+)\.(?:pdf|xml)$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPairer(t, pairer, []pairerCase{
+		{"pnas.201600001.pdf", "pnas.201600001", true},
+		{"pnas.201600001.xml", "pnas.201600001", true},
+		{"pnas.201600001.jpg", "", false},
+	})
+
+	if _, err := NewRegex(`\.pdf$`); err == nil {
+		t.Error("expected error for pattern without capture group")
+	}
+	if _, err := NewRegex(`(`); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestManifest(t *testing.T) {
+
+	manifest := &Manifest{Filename: "manifest.csv", Fallback: Basename{}}
+
+	if !manifest.Inspects("issue/manifest.csv") || manifest.Inspects("issue/abc.xml") {
+		t.Error("manifest inspects the wrong entries")
+	}
+
+	err := manifest.Inspect("issue/manifest.csv", strings.NewReader(
+		"10.1093/abc,abc.pdf,abc_meta.xml\n10.1093/def, def_full.pdf, def.xml\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testPairer(t, manifest, []pairerCase{
+		{"issue/abc.pdf", "10.1093/abc", true},
+		{"issue/abc_meta.xml", "10.1093/abc", true},
+		{"issue/def_full.pdf", "10.1093/def", true},
+		{"issue/def.xml", "10.1093/def", true},
+		{"issue/ghi.pdf", "ghi", true},
+	})
+
+	testPairer(t, &Manifest{Filename: "manifest.csv"}, []pairerCase{
+		{"issue/abc.pdf", "", false},
+	})
+}
+
+func TestMakePairs(t *testing.T) {
+
+	items := []Item{
+		{Name: "a.pdf", Key: "p/a.pdf", Class: Content},
+		{Name: "a.xml", Key: "p/a.xml.gz", Class: Meta},
+		{Name: "b.pdf", Key: "p/b.pdf", Class: Content},
+		{Name: "a.jpg", Key: "p/a.jpg", Class: Other},
+		{Name: "c.xml", Key: "p/c.xml.gz", Class: Meta},
+	}
+
+	pairer, _ := NewRegex(`^([ab])\.`)
+	pairs, unpaired := MakePairs(pairer, items)
+
+	expected := map[string]*Pair{
+		"a": {Content: "p/a.pdf", Meta: "p/a.xml.gz"},
+		"b": {Content: "p/b.pdf"},
+	}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+	if len(unpaired) != 1 || unpaired[0].Name != "c.xml" {
+		t.Errorf("unexpected unpaired items %v", unpaired)
+	}
+}
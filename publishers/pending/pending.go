@@ -0,0 +1,169 @@
+// Package pending keeps track of deliveries that arrive as several companion
+// archives, each with its own queue message. Arrivals are recorded in the
+// local state database so a delivery survives restarts while it waits for
+// the rest of its companions.
+package pending
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrNoDB is returned when the store has no state database to write to.
+var ErrNoDB = errors.New("pending: no state database")
+
+// Part is a companion archive that has arrived.
+type Part struct {
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	Arrived time.Time `json:"arrived"`
+}
+
+// Delivery is the set of companions of a delivery that have arrived so far,
+// by companion name.
+type Delivery struct {
+	Name  string           `json:"name"`
+	Parts map[string]*Part `json:"parts"`
+	// First is when the first companion arrived, timeouts count from it.
+	First time.Time `json:"first"`
+}
+
+// Has reports whether the companion has arrived.
+func (d *Delivery) Has(part string) bool {
+	_, ok := d.Parts[part]
+	return ok
+}
+
+// Missing lists the companions of parts that haven't arrived.
+func (d *Delivery) Missing(parts []string) []string {
+	missing := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if !d.Has(part) {
+			missing = append(missing, part)
+		}
+	}
+	return missing
+}
+
+// Store records the deliveries of a publisher.
+type Store struct {
+	db     *bolt.DB
+	bucket []byte
+	parts  []string
+
+	now func() time.Time
+}
+
+// New returns the store of the deliveries named name in db. A delivery is
+// complete once every one of parts has arrived.
+func New(db *bolt.DB, name string, parts []string) *Store {
+	return &Store{
+		db:     db,
+		bucket: []byte("pending/" + name),
+		parts:  parts,
+		now:    time.Now,
+	}
+}
+
+// Arrive records the arrival of a companion of the delivery name and
+// returns the delivery. A complete delivery stays in the store until it is
+// Done, so one whose processing fails is still complete when its message
+// comes back. Recording a companion twice is harmless.
+func (s *Store) Arrive(name, part string, p *Part) (*Delivery, bool, error) {
+
+	if s.db == nil {
+		return nil, false, ErrNoDB
+	}
+
+	var (
+		delivery *Delivery
+		complete bool
+	)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return err
+		}
+
+		delivery = &Delivery{Name: name, Parts: make(map[string]*Part, len(s.parts)), First: s.now()}
+		if v := b.Get([]byte(name)); v != nil {
+			if err := json.Unmarshal(v, delivery); err != nil {
+				return err
+			}
+		}
+
+		if p.Arrived.IsZero() {
+			p.Arrived = s.now()
+		}
+		delivery.Parts[part] = p
+
+		complete = len(delivery.Missing(s.parts)) == 0
+		return put(b, delivery)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return delivery, complete, nil
+}
+
+// Expired returns the deliveries whose first companion arrived longer than
+// age ago. They stay in the store until they are Done.
+func (s *Store) Expired(age time.Duration) ([]*Delivery, error) {
+
+	if s.db == nil {
+		return nil, ErrNoDB
+	}
+
+	deadline := s.now().Add(-age)
+	expired := make([]*Delivery, 0)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			delivery := &Delivery{}
+			if err := json.Unmarshal(v, delivery); err != nil {
+				return err
+			}
+			if delivery.First.Before(deadline) {
+				expired = append(expired, delivery)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// Done removes the delivery once it is processed, or given up on.
+func (s *Store) Done(name string) error {
+
+	if s.db == nil {
+		return ErrNoDB
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+func put(b *bolt.Bucket, delivery *Delivery) error {
+	v, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(delivery.Name), v)
+}
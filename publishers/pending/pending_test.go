@@ -0,0 +1,121 @@
+package pending
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func openDB(t *testing.T) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestArrive(t *testing.T) {
+
+	store := New(openDB(t), "pnas", []string{".xml.zip", ".pdf.zip"})
+
+	delivery, complete, err := store.Arrive("113_26/pnas_113_26", ".xml.zip", &Part{Key: "a.xml.zip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete {
+		t.Error("delivery complete with one companion")
+	}
+	if missing := delivery.Missing(store.parts); len(missing) != 1 || missing[0] != ".pdf.zip" {
+		t.Errorf("unexpected missing companions %v", missing)
+	}
+
+	// a redelivered message changes nothing
+	if _, complete, _ = store.Arrive("113_26/pnas_113_26", ".xml.zip", &Part{Key: "a.xml.zip"}); complete {
+		t.Error("delivery complete with one companion")
+	}
+
+	delivery, complete, err = store.Arrive("113_26/pnas_113_26", ".pdf.zip", &Part{Key: "a.pdf.zip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Fatal("delivery not complete")
+	}
+	if delivery.Parts[".xml.zip"].Key != "a.xml.zip" || delivery.Parts[".pdf.zip"].Key != "a.pdf.zip" {
+		t.Errorf("unexpected parts %v", delivery.Parts)
+	}
+
+	// complete deliveries leave the store once they are done
+	if err := store.Done("113_26/pnas_113_26"); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := store.Expired(-time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("unexpected expired deliveries %v", expired)
+	}
+}
+
+func TestArriveFailed(t *testing.T) {
+
+	store := New(openDB(t), "pnas", []string{".xml.zip", ".pdf.zip"})
+
+	store.Arrive("a", ".xml.zip", &Part{Key: "a.xml.zip"})
+	if _, complete, _ := store.Arrive("a", ".pdf.zip", &Part{Key: "a.pdf.zip"}); !complete {
+		t.Fatal("delivery not complete")
+	}
+
+	// processing failed, the redelivered message completes it again
+	delivery, complete, err := store.Arrive("a", ".pdf.zip", &Part{Key: "a.pdf.zip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete || delivery.Parts[".xml.zip"].Key != "a.xml.zip" {
+		t.Fatalf("delivery lost after a failure, got %v complete %v", delivery.Parts, complete)
+	}
+}
+
+func TestExpired(t *testing.T) {
+
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := New(openDB(t), "pnas", []string{".xml.zip", ".pdf.zip"})
+	store.now = func() time.Time { return now }
+
+	store.Arrive("old", ".xml.zip", &Part{Key: "old.xml.zip"})
+	now = now.Add(2 * time.Hour)
+	store.Arrive("new", ".xml.zip", &Part{Key: "new.xml.zip"})
+
+	expired, err := store.Expired(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].Name != "old" {
+		t.Fatalf("unexpected expired deliveries %v", expired)
+	}
+
+	// expired deliveries are handed out until they are done
+	if expired, _ = store.Expired(time.Hour); len(expired) != 1 {
+		t.Errorf("expired delivery not handed out again")
+	}
+	if err := store.Done("old"); err != nil {
+		t.Fatal(err)
+	}
+	if expired, _ = store.Expired(time.Hour); len(expired) != 0 {
+		t.Errorf("done delivery handed out")
+	}
+}
+
+func TestNoDB(t *testing.T) {
+	store := New(nil, "pnas", nil)
+	if _, _, err := store.Arrive("a", ".xml.zip", &Part{}); err != ErrNoDB {
+		t.Errorf("expected ErrNoDB, got %v", err)
+	}
+	if err := store.Done("a"); err != ErrNoDB {
+		t.Errorf("expected ErrNoDB, got %v", err)
+	}
+}
@@ -1,166 +1,276 @@
 package pnas
 
 import (
-	"archive/zip"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"path"
+	"regexp"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/yewno/acquisition/config"
 	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/publishers/archive"
+	"github.com/yewno/acquisition/publishers/manifest"
+	"github.com/yewno/acquisition/publishers/orphans"
+	"github.com/yewno/acquisition/publishers/pending"
 	"github.com/yewno/acquisition/services"
 )
 
-var extensions = []string{".xml.zip", ".pdf.zip"}
+// A pnas delivery is split over companion archives named after the issue,
+// pnas_113_26.xml.zip, pnas_113_26.pdf.zip and so on, each arriving with its
+// own message. The xml and pdf archives are needed to pair anything, the
+// others hold images and supplementary files for the articles.
+var (
+	required    = []string{".xml.zip", ".pdf.zip"}
+	attachments = []string{".img.zip", ".peripherals.zip", ".text_images.zip"}
+	companions  = append(append([]string{}, required...), attachments...)
+)
+
+// defaultTimeout is how long a delivery waits for missing companions when
+// the config doesn't say.
+const defaultTimeout = 24 * time.Hour
+
+// byName pairs an article's pdf and xml on the entry name without the
+// extension, both zips use the same names. It is the fallback for articles
+// whose metadata doesn't name its pdf.
+var byName = &publishers.Regex{Pattern: regexp.MustCompile(`^(.+)\.(?:pdf|xml)$`)}
 
 type Object struct {
 	conn  services.CobaltStorage
 	queue services.CobaltQueue
 	cfg   *config.Config
-	wg    *sync.WaitGroup
-	pool  chan bool
 
-	stats *publishers.Stats
+	stats   *publishers.Stats
+	pending *pending.Store
+	orphans *orphans.Ledger
+}
+
+func init() {
+	publishers.Register("pnas", NewObject)
 }
 
-func NewObject(conn services.CobaltStorage, queue services.CobaltQueue, wg *sync.WaitGroup, cfg *config.Config, pool chan bool, stats *publishers.Stats) *Object {
-	wg.Add(1)
+func NewObject(env *publishers.Env) publishers.Processor {
 	return &Object{
-		conn:  conn,
-		queue: queue,
-		wg:    wg,
-		cfg:   cfg,
-		pool:  pool,
+		conn:  env.Storage,
+		queue: env.Queue,
+		cfg:   env.Config,
 
-		stats: stats,
+		stats:   env.Stats,
+		pending: pending.New(env.DB, "pnas", companions),
+		orphans: orphans.New(env.DB, "pnas"),
 	}
 }
 
-func (o *Object) Process(receipt string, message *services.SnsMessage) error {
+func (o *Object) Process(ctx context.Context, job *publishers.Job) publishers.Result {
+	count, err := o.process(ctx, job)
+	return publishers.Result{Publisher: "pnas", Pairs: count, Err: err}
+}
 
-	defer o.wg.Done()
-	defer func() { <-o.pool }()
+// Sweep processes the deliveries that have waited longer than the pending
+// timeout, as long as their xml and pdf archives are there. Deliveries
+// missing either are reported and dropped, as are orphans that waited too
+// long for their pair.
+func (o *Object) Sweep(ctx context.Context) []publishers.Result {
 
-	var (
-		bucket = message.Records[0].S3.Bucket.Name
-		key    = message.Records[0].S3.Object.Key
-		size   = message.Records[0].S3.Object.Size
-		pairs  = make(map[string]*publishers.Pair, 100)
-	)
-	zipFilename := key
+	results := make([]publishers.Result, 0)
+	if err := o.orphans.Sweep(o.cfg.OrphanAge, o.stats); err != nil {
+		log.Println(err)
+		results = append(results, publishers.Result{Publisher: "pnas", Err: err})
+	}
 
-	log.Println(bucket, key)
+	timeout := o.cfg.PendingTimeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
 
-	if !strings.HasSuffix(key, ".xml.zip") {
-		return o.removeMessage(receipt)
+	expired, err := o.pending.Expired(timeout)
+	if err != nil {
+		log.Println(err)
+		return append(results, publishers.Result{Publisher: "pnas", Err: err})
 	}
 
-	// Get meta files
-	object := services.NewObject(nil, bucket, key, size)
+	for _, delivery := range expired {
 
-	err := o.conn.Get(object)
-	if err != nil {
-		return err
+		if missing := delivery.Missing(required); len(missing) > 0 {
+			o.stats.ProblemFilenames <- fmt.Sprintf("%s: gave up waiting for %s", delivery.Name, strings.Join(missing, ", "))
+			if err := o.pending.Done(delivery.Name); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+
+		// a delivery that fails is tried again on the next sweep
+		count, err := o.deliver(ctx, delivery, false)
+		if err == nil {
+			if err = o.pending.Done(delivery.Name); err != nil {
+				log.Println(err)
+			}
+		}
+		results = append(results, publishers.Result{Publisher: "pnas", Pairs: count, Err: err})
 	}
+	return results
+}
 
-	readerXml, err := zip.NewReader(object.File, object.Size)
-	if err != nil {
-		return err
+// Delivery is the issue the companion under key belongs to.
+func (o *Object) Delivery(key string) string {
+	return strings.TrimSuffix(key, companionOf(key))
+}
+
+func (o *Object) process(ctx context.Context, job *publishers.Job) (int, error) {
+
+	key := job.Key()
+
+	companion := companionOf(key)
+	if companion == "" {
+		return 0, o.removeMessage(ctx, job.Receipt)
 	}
+	name := strings.TrimSuffix(key, companion)
 
-	// Get content files
-	key = fmt.Sprintf("%s.pdf.zip", strings.TrimSuffix(key, ".xml.zip"))
-	object = services.NewObject(nil, bucket, key, 0)
+	if job.Direct {
+		delivery, err := o.stored(ctx, job.Bucket(), name)
+		if err != nil {
+			log.Println(err)
+			return 0, err
+		}
+		count, err := o.deliver(ctx, delivery, job.Redelivered())
+		if err != nil {
+			return count, err
+		}
+		return count, o.removeMessage(ctx, job.Receipt)
+	}
 
-	err = o.conn.Get(object)
+	part := &pending.Part{Bucket: job.Bucket(), Key: key, Size: job.Size()}
+	delivery, complete, err := o.pending.Arrive(name, companion, part)
 	if err != nil {
-		return err
+		log.Println(err)
+		return 0, err
 	}
 
-	readerZip, err := zip.NewReader(object.File, object.Size)
-	if err != nil {
-		return err
+	if !complete {
+		log.Printf("%s waiting for %s", name, strings.Join(delivery.Missing(companions), ", "))
+		return 0, o.removeMessage(ctx, job.Receipt)
 	}
 
-	dir, _ := path.Split(object.Key)
-	prefix := strings.Split(dir, "/")[2]
+	count, err := o.deliver(ctx, delivery, job.Redelivered())
+	if err != nil {
+		// the delivery stays pending, the message comes back and
+		// completes it again
+		return count, err
+	}
+	if err := o.pending.Done(name); err != nil {
+		log.Println(err)
+		return count, err
+	}
 
-	for _, reader := range []*zip.Reader{readerXml, readerZip} {
+	return count, o.removeMessage(ctx, job.Receipt)
+}
 
-		for _, zipFile := range reader.File {
+// stored is the delivery made of the companions already in the bucket, for
+// direct jobs that have no messages to wait for. It fails when the xml or
+// pdf archive is missing.
+func (o *Object) stored(ctx context.Context, bucket, name string) (*pending.Delivery, error) {
+
+	delivery := &pending.Delivery{Name: name, Parts: make(map[string]*pending.Part, len(companions))}
+	for _, companion := range companions {
+		object := services.NewObject(nil, bucket, name+companion, 0)
+		err := o.conn.Head(ctx, object)
+		if err == services.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		delivery.Parts[companion] = &pending.Part{Bucket: bucket, Key: object.Key, Size: object.Size}
+	}
 
-			if zipFile.FileInfo().IsDir() {
-				continue
-			}
+	if missing := delivery.Missing(required); len(missing) > 0 {
+		return nil, fmt.Errorf("%s: missing %s", name, strings.Join(missing, ", "))
+	}
+	return delivery, nil
+}
 
-			key := fmt.Sprintf("pnas/%s-%s", prefix, zipFile.Name)
-			base := zipFile.Name
-			for _, suffix := range []string{".pdf", ".xml"} {
-				base = strings.TrimSuffix(base, suffix)
-			}
-			ext := path.Ext(zipFile.Name)
+// deliver uploads the companions of a delivery and announces its pairs.
+// Pairs whose files didn't change are only sent again with resend.
+func (o *Object) deliver(ctx context.Context, delivery *pending.Delivery, resend bool) (int, error) {
 
-			f, err := zipFile.Open()
-			if err != nil {
-				continue
-			}
+	var (
+		xmlPart = delivery.Parts[".xml.zip"]
+		pdfPart = delivery.Parts[".pdf.zip"]
+		items   = make([]publishers.Item, 0, 100)
+		extras  = make([]publishers.Item, 0, 100)
+		pairer  = &publishers.JATS{Fallback: byName}
+		record  = manifest.New("pnas", delivery.Name)
+	)
+	zipFilename := xmlPart.Key
 
-			file, size, err := publishers.ArchiveEntryToFile(f)
-			if err != nil {
-				continue
-			}
-			f.Close()
+	log.Println(xmlPart.Bucket, xmlPart.Key)
 
-			object := services.NewObject(file, o.cfg.ProcessedBucket, key, size)
+	// Get meta files
+	readerXml, err := o.open(ctx, services.NewObject(nil, xmlPart.Bucket, xmlPart.Key, xmlPart.Size), record)
+	if err != nil {
+		return 0, err
+	}
+	defer readerXml.Close()
 
-			err = object.Save(o.conn)
-			object.Close()
+	// Get content files
+	readerZip, err := o.open(ctx, services.NewObject(nil, pdfPart.Bucket, pdfPart.Key, pdfPart.Size), record)
+	if err != nil {
+		return 0, err
+	}
+	defer readerZip.Close()
 
-			switch ext {
+	dir, _ := path.Split(zipFilename)
+	prefix := strings.Split(dir, "/")[2]
 
-			case ".pdf":
-				pair, ok := pairs[base]
-				if !ok {
-					pairs[base] = &publishers.Pair{Content: object.Key}
-				} else {
-					pair.Content = object.Key
-				}
-				o.stats.Content <- 1
+	for _, reader := range []*objectReader{readerXml, readerZip} {
+		uploaded, err := o.upload(ctx, reader, prefix, pairer, record)
+		if err != nil {
+			return 0, err
+		}
+		items = append(items, uploaded...)
+	}
 
-			case ".xml":
-				pair, ok := pairs[base]
-				if !ok {
-					pairs[base] = &publishers.Pair{Meta: object.Key}
-				} else {
-					pair.Meta = object.Key
-				}
-				o.stats.Meta <- 1
-
-			default:
-				o.stats.Other <- 1
-			}
+	for _, companion := range attachments {
+		part, ok := delivery.Parts[companion]
+		if !ok {
+			continue
+		}
 
-			if err != nil {
-				log.Println(err)
-			}
+		reader, err := o.open(ctx, services.NewObject(nil, part.Bucket, part.Key, part.Size), record)
+		if err != nil {
+			return 0, err
 		}
+		uploaded, err := o.upload(ctx, reader, prefix, nil, record)
+		reader.Close()
+		if err != nil {
+			return 0, err
+		}
+		extras = append(extras, uploaded...)
 	}
 
-	batch := o.queue.NewBatch(o.cfg.ProcessedQueue)
-	count := 0
+	pairs, unpaired := publishers.MakePairs(pairer, items)
+	for _, problem := range pairer.Problems() {
+		o.stats.ProblemFilenames <- fmt.Sprintf("%s/%s", zipFilename, problem)
+	}
+
+	if _, err := o.orphans.Match(zipFilename, pairs); err != nil {
+		log.Println(err)
+	}
+
+	record.Pairs(pairs, unpaired)
+
+	messages := make([]*services.PairMessage, 0, len(pairs))
 	for _, p := range pairs {
 		if p.Meta != "" && p.Content != "" {
-			count++
-			m := &services.PairMessage{
+			messages = append(messages, &services.PairMessage{
 				Source:  "pnas",
 				Bucket:  o.cfg.ProcessedBucket,
 				Key:     p.Content,
 				MetaKey: p.Meta,
-			}
-			o.stats.Pairs <- 1
-			batch.Add(m)
+			})
 		} else {
 			var key string
 			if p.Meta == "" {
@@ -173,15 +283,243 @@ func (o *Object) Process(receipt string, message *services.SnsMessage) error {
 			o.stats.ProblemFilenames <- fmt.Sprintf("%s/%s", zipFilename, key)
 		}
 	}
+
+	for _, extra := range attach(messages, items, extras) {
+		o.stats.ProblemFilenames <- fmt.Sprintf("%s/%s: not attached to any article", zipFilename, extra.Name)
+	}
+
+	unchanged := publishers.Unchanged(append(items, extras...))
+	if resend {
+		unchanged = nil
+	}
+
+	var sendErr error
+	batch := o.queue.NewBatch(ctx, o.cfg.ProcessedQueue)
+	count := 0
+	for _, m := range messages {
+		if unchanged[m.Key] && unchanged[m.MetaKey] && allUnchanged(m.Attachments, unchanged) {
+			o.stats.SkippedPairs <- 1
+			continue
+		}
+		if err := batch.Add(m); err != nil {
+			log.Println(err)
+			sendErr = err
+			continue
+		}
+		count++
+		o.stats.Pairs <- 1
+		record.Sent(m)
+	}
 	o.stats.Report <- fmt.Sprintf("pnas:%d", count)
-	batch.Flush()
+	if err := batch.Flush(); err != nil {
+		// the message isn't deleted, it comes back to send the pairs again
+		log.Println(err)
+		return count, err
+	}
+	if sendErr != nil {
+		return count, sendErr
+	}
+	if err := o.orphans.Release(pairs); err != nil {
+		log.Println(err)
+	}
+	if ctx.Err() != nil {
+		return count, ctx.Err()
+	}
 
-	o.removeMessage(receipt)
-	return nil
+	if err := record.Save(ctx, o.conn, o.cfg.ProcessedBucket, o.cfg.ManifestPrefix); err != nil {
+		log.Println(err)
+	}
+
+	return count, nil
+}
+
+// upload saves every entry of the archive under pnas/ and returns them for
+// pairing. Entries the inspector asks for are inspected on the way. It
+// fails when the archive can't be read to the end, any entry fails to
+// upload, or the context is done.
+func (o *Object) upload(ctx context.Context, reader *objectReader, prefix string, inspector publishers.Inspector, record *manifest.Manifest) ([]publishers.Item, error) {
+
+	type saved struct {
+		name   string
+		class  publishers.Class
+		object *services.Object
+		err    error
+	}
+
+	uploads := publishers.NewUploads(publishers.Concurrency(o.cfg, "pnas", 0))
+	entries := make([]*saved, 0, 100)
+
+	// a failed read leaves the rest of the archive out, the entries
+	// uploaded so far are waited for before failing
+	var failed error
+	for ctx.Err() == nil {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println(reader.object.Key, err)
+			failed = err
+			break
+		}
+
+		key := fmt.Sprintf("pnas/%s-%s", prefix, entry.Name)
+
+		body, err := publishers.Inspect(inspector, entry.Name, entry)
+		if err != nil {
+			log.Printf("%s/%s: %v", reader.object.Key, entry.Name, err)
+			failed = err
+			break
+		}
+
+		class := publishers.Other
+		if inspector != nil {
+			switch path.Ext(entry.Name) {
+			case ".pdf":
+				class = publishers.Content
+			case ".xml":
+				class = publishers.Meta
+			}
+		}
+
+		s := &saved{name: entry.Name, class: class, object: services.NewObject(nil, o.cfg.ProcessedBucket, key, 0)}
+		s.object.Compression = publishers.Compression(o.cfg, "pnas", nil)
+		s.object.Tags = publishers.Tags("pnas", reader.object.Key, class)
+		err = uploads.Go(body, func(body io.Reader) {
+			s.err = s.object.SaveStream(ctx, o.conn, body)
+		})
+		if err != nil {
+			s.err = err
+		}
+		entries = append(entries, s)
+	}
+	uploads.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	for _, s := range entries {
+		if s.err != nil {
+			log.Printf("%s/%s: %v", reader.object.Key, s.name, s.err)
+			failed = s.err
+		}
+	}
+	if failed != nil {
+		return nil, failed
+	}
+
+	items := make([]publishers.Item, 0, len(entries))
+	for _, s := range entries {
+		if s.object.Unchanged {
+			o.stats.Skipped <- 1
+		}
+		switch s.class {
+		case publishers.Content:
+			o.stats.Content <- 1
+		case publishers.Meta:
+			o.stats.Meta <- 1
+		default:
+			o.stats.Other <- 1
+		}
+
+		record.Add(reader.object.Key, s.name, s.object, s.class)
+		items = append(items, publishers.Item{Name: s.name, Key: s.object.Key, Class: s.class, Unchanged: s.object.Unchanged})
+	}
+	return items, nil
+}
+
+// attach hands every extra to the article whose pdf or xml file name, less
+// the extension, its file name starts with. pnas.1601234113.sapp.pdf
+// belongs to pnas.1601234113.xml. The longest match wins, extras no article
+// claims are returned.
+func attach(messages []*services.PairMessage, items, extras []publishers.Item) []publishers.Item {
+
+	names := make(map[string]string, len(items))
+	for _, item := range items {
+		names[item.Key] = item.Name
+	}
+
+	articles := make(map[string]*services.PairMessage, 2*len(messages))
+	for _, m := range messages {
+		for _, key := range []string{m.Key, m.MetaKey} {
+			// halves paired up from earlier deliveries aren't in items
+			if name, ok := names[key]; ok {
+				fn := path.Base(name)
+				articles[strings.TrimSuffix(fn, path.Ext(fn))] = m
+			}
+		}
+	}
+
+	unattached := make([]publishers.Item, 0)
+	for _, extra := range extras {
+		fn := path.Base(extra.Name)
+
+		var (
+			match   *services.PairMessage
+			longest int
+		)
+		for id, m := range articles {
+			if len(id) > longest && strings.HasPrefix(fn, id) {
+				match, longest = m, len(id)
+			}
+		}
+
+		if match == nil {
+			unattached = append(unattached, extra)
+			continue
+		}
+		match.Attachments = append(match.Attachments, extra.Key)
+	}
+	return unattached
+}
+
+func allUnchanged(keys []string, unchanged map[string]bool) bool {
+	for _, key := range keys {
+		if !unchanged[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// companionOf returns which companion archive of a delivery key is, empty
+// if it isn't one.
+func companionOf(key string) string {
+	for _, companion := range companions {
+		if strings.HasSuffix(key, companion) {
+			return companion
+		}
+	}
+	return ""
+}
+
+// open returns a reader over the entries of a companion archive, read in
+// place in the ftp bucket.
+func (o *Object) open(ctx context.Context, object *services.Object, record *manifest.Manifest) (*objectReader, error) {
+
+	reader, err := publishers.OpenArchive(ctx, o.conn, object)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	if err := record.Source(object); err != nil {
+		log.Println(err)
+	}
+	return &objectReader{Reader: reader, object: object}, nil
+}
+
+type objectReader struct {
+	archive.Reader
+	object *services.Object
+}
+
+func (r *objectReader) Close() error {
+	r.Reader.Close()
+	return r.object.Close()
 }
 
-func (o *Object) removeMessage(receipt string) error {
-	if err := o.queue.Pop(o.cfg.NewContentQueue, receipt); err != nil {
+func (o *Object) removeMessage(ctx context.Context, receipt string) error {
+	if err := o.queue.Pop(ctx, o.cfg.NewContentQueue, receipt); err != nil {
 		log.Println(err)
 		return err
 	}
@@ -1,42 +1,117 @@
 package pnas
 
 import (
+	"archive/zip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"sync"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/yewno/acquisition/config"
 	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/publishers/backfill"
 	"github.com/yewno/acquisition/services"
 )
 
-func TestProcess(t *testing.T) {
+const issue = "files/pnas/113_26/pnas_113_26"
+
+var deliveries = map[string]map[string]string{
+	".xml.zip": {
+		"pnas.1601234113.xml": `<article><front><self-uri xlink:href="pnas.1601234113.pdf"/></front></article>`,
+		"pnas.1605678113.xml": `<article/>`,
+	},
+	".pdf.zip": {
+		"pnas.1601234113.pdf": "%PDF",
+		"pnas.1605678113.pdf": "%PDF",
+	},
+	".img.zip": {
+		"pnas.1601234113fig01.jpg": "jpg",
+	},
+	".peripherals.zip": {
+		"pnas.1605678113.sapp.pdf": "%PDF",
+		"cover.pdf":                "%PDF",
+	},
+	".text_images.zip": {},
+}
+
+type fixture struct {
+	dir     string
+	obj     publishers.Processor
+	storage *publishers.MockStorage
+	queue   *publishers.MockQueue
+	stats   *publishers.Stats
+}
+
+func newFixture(t *testing.T, timeout time.Duration) *fixture {
 
-	conn := &publishers.MockStorage{}
-	queue := &publishers.MockQueue{}
-	stats := publishers.NewStats()
-	var wg sync.WaitGroup
-	wg.Add(1)
+	dir := t.TempDir()
 
-	pool := make(chan bool, 1)
-	pool <- true
+	for companion, entries := range deliveries {
+		filename := filepath.Join(dir, issue+companion)
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer := zip.NewWriter(file)
+		for name, body := range entries {
+			w, err := writer.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprint(w, body)
+		}
+		writer.Close()
+		file.Close()
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	f := &fixture{
+		dir:     dir,
+		storage: &publishers.MockStorage{},
+		queue:   &publishers.MockQueue{},
+		stats:   publishers.NewStats(),
+	}
 
 	cfg := &config.Config{
 		ProcessedQueue:  "processQueue",
-		ProcessedBucket: "../../test/",
+		ProcessedBucket: filepath.Join(dir, "processed"),
 		NewContentQueue: "newContentQueue",
+		PendingTimeout:  timeout,
 	}
 
-	obj := &Object{
-		conn:  conn,
-		queue: queue,
-		wg:    &wg,
-		cfg:   cfg,
-		pool:  pool,
-		stats: stats,
+	f.obj, err = publishers.New("pnas", &publishers.Env{
+		Storage: f.storage,
+		Queue:   f.queue,
+		Config:  cfg,
+		Stats:   f.stats,
+		DB:      db,
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
+	return f
+}
+
+func (f *fixture) arrive(t *testing.T, companion string) publishers.Result {
+	return f.obj.Process(context.Background(), f.job(t, companion))
+}
+
+func (f *fixture) job(t *testing.T, companion string) *publishers.Job {
 
 	msgString := fmt.Sprintf(
 		`{"Records":[{
@@ -46,19 +121,236 @@ func TestProcess(t *testing.T) {
 				}
 			}
 		]}`,
-		"../../test",
-		"files/pnas/113_26/pnas_113_26.xml.zip",
+		f.dir,
+		issue+companion,
 		"1",
 	)
 
 	msg := &services.SnsMessage{}
+	if err := json.Unmarshal([]byte(msgString), msg); err != nil {
+		t.Fatal(err)
+	}
+	return publishers.NewJob("foo", msg)
+}
+
+func (f *fixture) messages(t *testing.T) map[string]*services.PairMessage {
+	messages := make(map[string]*services.PairMessage, len(f.queue.Messages))
+	for _, body := range f.queue.Messages {
+		m := &services.PairMessage{}
+		if err := json.Unmarshal([]byte(body), m); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(m.Attachments)
+		messages[m.MetaKey] = m
+	}
+	return messages
+}
+
+func (f *fixture) problems() []string {
+	problems := make([]string, 0)
+	for {
+		select {
+		case problem := <-f.stats.ProblemFilenames:
+			problems = append(problems, problem)
+		default:
+			sort.Strings(problems)
+			return problems
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+
+	f := newFixture(t, time.Hour)
+
+	for _, companion := range []string{".pdf.zip", ".img.zip", ".xml.zip", ".text_images.zip"} {
+		if result := f.arrive(t, companion); result.Err != nil || result.Pairs != 0 {
+			t.Fatalf("%s: unexpected result %v", companion, result)
+		}
+	}
+	if len(f.queue.Messages) != 0 {
+		t.Fatalf("pairs sent before the delivery is complete: %v", f.queue.Messages)
+	}
+
+	result := f.arrive(t, ".peripherals.zip")
+	if result.Err != nil || result.Pairs != 2 {
+		t.Fatalf("unexpected result %v", result)
+	}
+
+	expected := map[string]*services.PairMessage{
+		"pnas/113_26-pnas.1601234113.xml.gz": {
+			Source:      "pnas",
+			Bucket:      filepath.Join(f.dir, "processed"),
+			Key:         "pnas/113_26-pnas.1601234113.pdf",
+			MetaKey:     "pnas/113_26-pnas.1601234113.xml.gz",
+			Attachments: []string{"pnas/113_26-pnas.1601234113fig01.jpg"},
+		},
+		"pnas/113_26-pnas.1605678113.xml.gz": {
+			Source:      "pnas",
+			Bucket:      filepath.Join(f.dir, "processed"),
+			Key:         "pnas/113_26-pnas.1605678113.pdf",
+			MetaKey:     "pnas/113_26-pnas.1605678113.xml.gz",
+			Attachments: []string{"pnas/113_26-pnas.1605678113.sapp.pdf"},
+		},
+	}
+	if messages := f.messages(t); !reflect.DeepEqual(messages, expected) {
+		t.Errorf("unexpected messages %v", f.queue.Messages)
+	}
+
+	problems := f.problems()
+	if len(problems) != 1 || problems[0] != issue+".xml.zip/cover.pdf: not attached to any article" {
+		t.Errorf("unexpected problems %q", problems)
+	}
+
+	// the companions are read in place, not downloaded
+	if f.storage.Ranges == 0 {
+		t.Error("no ranged reads of the companions")
+	}
+	if _, err := os.Stat(filepath.Join(f.dir, issue+".xml.zip")); err != nil {
+		t.Error(err)
+	}
+
+	// attachments are uploaded along with the articles
+	if _, err := os.Stat(filepath.Join(f.dir, "processed", "pnas/113_26-pnas.1601234113fig01.jpg")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+
+	f := newFixture(t, time.Nanosecond)
+	f.arrive(t, ".xml.zip")
+	f.arrive(t, ".pdf.zip")
+	time.Sleep(time.Millisecond)
 
-	err := json.Unmarshal([]byte(msgString), msg)
+	results := f.obj.(publishers.Sweeper).Sweep(context.Background())
+	if len(results) != 1 || results[0].Err != nil || results[0].Pairs != 2 {
+		t.Fatalf("unexpected results %v", results)
+	}
+	for _, m := range f.messages(t) {
+		if len(m.Attachments) != 0 {
+			t.Errorf("unexpected attachments %v", m.Attachments)
+		}
+	}
+
+	// swept deliveries are gone
+	if results := f.obj.(publishers.Sweeper).Sweep(context.Background()); len(results) != 0 {
+		t.Errorf("unexpected results %v", results)
+	}
+}
+
+func TestSweepIncomplete(t *testing.T) {
 
-	err = obj.Process("foo", msg)
+	f := newFixture(t, time.Nanosecond)
+	f.arrive(t, ".xml.zip")
+	f.arrive(t, ".img.zip")
+	time.Sleep(time.Millisecond)
+
+	if results := f.obj.(publishers.Sweeper).Sweep(context.Background()); len(results) != 0 {
+		t.Errorf("unexpected results %v", results)
+	}
+	if len(f.queue.Messages) != 0 {
+		t.Errorf("unexpected messages %v", f.queue.Messages)
+	}
+
+	problems := f.problems()
+	if len(problems) != 1 || problems[0] != issue+": gave up waiting for .pdf.zip" {
+		t.Errorf("unexpected problems %q", problems)
+	}
+}
 
-	log.Println(err)
+func TestProcessFailed(t *testing.T) {
+
+	f := newFixture(t, time.Hour)
+	for _, companion := range []string{".xml.zip", ".pdf.zip", ".img.zip", ".text_images.zip"} {
+		f.arrive(t, companion)
+	}
+
+	f.queue.SendErr = errors.New("down")
+	if result := f.arrive(t, ".peripherals.zip"); result.Err == nil {
+		t.Fatalf("unexpected result %v", result)
+	}
+
+	// the redelivered message finds the delivery still complete
+	f.queue.SendErr = nil
+	job := f.job(t, ".peripherals.zip")
+	job.Attempts = 2
+	if result := f.obj.Process(context.Background(), job); result.Err != nil || result.Pairs != 2 {
+		t.Fatalf("unexpected result %v", result)
+	}
+	if len(f.queue.Messages) != 2 {
+		t.Errorf("unexpected messages %v", f.queue.Messages)
+	}
+}
+
+func TestProcessPopFailure(t *testing.T) {
+
+	f := newFixture(t, time.Hour)
+	for _, companion := range []string{".xml.zip", ".pdf.zip", ".img.zip", ".text_images.zip"} {
+		f.arrive(t, companion)
+	}
 
-	log.Println(queue.Messages)
-	log.Println(len(queue.Messages))
+	// the pairs are sent but the message comes back
+	f.queue.PopErr = errors.New("down")
+	if result := f.arrive(t, ".peripherals.zip"); result.Err == nil {
+		t.Fatalf("expected the delete failure, got %v", result)
+	}
+}
+
+func TestProcessDirect(t *testing.T) {
+
+	f := newFixture(t, time.Nanosecond)
+
+	// any companion delivers whatever of the issue is in the bucket
+	job := publishers.NewDirectJob(f.dir, issue+".img.zip", 1)
+	if result := f.obj.Process(context.Background(), job); result.Err != nil || result.Pairs != 2 {
+		t.Fatalf("unexpected result %v", result)
+	}
+	if m := f.messages(t)["pnas/113_26-pnas.1601234113.xml.gz"]; m == nil || len(m.Attachments) != 1 {
+		t.Errorf("unexpected messages %v", f.queue.Messages)
+	}
+
+	// nothing is left pending for the sweep
+	time.Sleep(time.Millisecond)
+	if results := f.obj.(publishers.Sweeper).Sweep(context.Background()); len(results) != 0 {
+		t.Errorf("unexpected results %v", results)
+	}
+
+	if err := os.Remove(filepath.Join(f.dir, issue+".pdf.zip")); err != nil {
+		t.Fatal(err)
+	}
+	job = publishers.NewDirectJob(f.dir, issue+".xml.zip", 1)
+	if result := f.obj.Process(context.Background(), job); result.Err == nil {
+		t.Error("expected an error without the pdf archive")
+	}
+}
+
+func TestBackfill(t *testing.T) {
+
+	f := newFixture(t, time.Hour)
+
+	// every companion is listed, the issue is delivered once
+	filter := &backfill.Filter{Delivery: f.obj.(publishers.Grouper).Delivery}
+	deliveries, err := backfill.Deliveries(context.Background(), f.storage, f.dir, "pnas", filter, backfill.NewProgress(nil, "pnas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("expected 1 delivery, got %d", len(deliveries))
+	}
+
+	// enqueued, the job is still direct and its message deleted
+	for _, d := range deliveries {
+		job := publishers.NewJob("backfill", publishers.NewDirectJob(d.Bucket, d.Key, d.Size).Message)
+		job.Resend = true
+		if result := f.obj.Process(context.Background(), job); result.Err != nil || result.Pairs != 2 {
+			t.Fatalf("unexpected result %v", result)
+		}
+	}
+	if len(f.queue.Messages) != 2 {
+		t.Errorf("expected each pair sent once, got %v", f.queue.Messages)
+	}
+	if len(f.queue.Popped) != 1 || f.queue.Popped[0] != "backfill" {
+		t.Errorf("unexpected deleted messages %v", f.queue.Popped)
+	}
 }
@@ -0,0 +1,161 @@
+package publishers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/config"
+	"github.com/yewno/acquisition/services"
+)
+
+// Job is a single archive delivery pulled off the new content queue.
+type Job struct {
+	Receipt string
+	Message *services.SnsMessage
+	// Attempts is how many times the queue message has been received,
+	// this time included.
+	Attempts int
+	// Resend sends the pairs of unchanged entries again, like for a
+	// redelivery.
+	Resend bool
+	// Direct jobs weren't started by an S3 event but run by hand or
+	// enqueued by a backfill, no other message will complete their
+	// delivery.
+	Direct bool
+}
+
+// NewJob wraps an sns message and the receipt of the queue message it came in.
+func NewJob(receipt string, message *services.SnsMessage) *Job {
+	return &Job{
+		Receipt: receipt,
+		Message: message,
+		Direct:  message.Direct,
+	}
+}
+
+// Redelivered reports whether an earlier attempt at the job didn't finish.
+// It may have uploaded entries without sending their pairs, so pairs of
+// unchanged entries are sent again. So are they when the job asks to
+// Resend.
+func (j *Job) Redelivered() bool {
+	return j.Attempts > 1 || j.Resend
+}
+
+// Bucket is the bucket the delivery was uploaded to.
+func (j *Job) Bucket() string {
+	return j.Message.Records[0].S3.Bucket.Name
+}
+
+// Key is the key of the delivered archive.
+func (j *Job) Key() string {
+	return j.Message.Records[0].S3.Object.Key
+}
+
+// Size is the size of the delivered archive as reported by S3.
+func (j *Job) Size() int64 {
+	return j.Message.Records[0].S3.Object.Size
+}
+
+// Publisher is the routing key of the job, the directory the publisher
+// uploads into (files/<publisher>/...).
+func (j *Job) Publisher() string {
+	if len(j.Message.Records) == 0 {
+		return ""
+	}
+	parts := strings.Split(j.Key(), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Result is the outcome of processing a single job.
+type Result struct {
+	Publisher string
+	Pairs     int
+	Err       error
+}
+
+// Processor expands an archive delivery and announces the pairs found in it.
+type Processor interface {
+	Process(context.Context, *Job) Result
+}
+
+// Grouper is implemented by processors whose deliveries are split over
+// several archives. Delivery names the delivery the archive under key
+// belongs to, a direct job for any of them processes all of it.
+type Grouper interface {
+	Delivery(key string) string
+}
+
+// Sweeper is implemented by processors that hold on to work between jobs.
+// Sweep is called periodically to finish work that has waited too long.
+type Sweeper interface {
+	Sweep(context.Context) []Result
+}
+
+// Env is everything a processor needs to talk to the outside world.
+type Env struct {
+	Storage services.CobaltStorage
+	Queue   services.CobaltQueue
+	Config  *config.Config
+	Stats   *Stats
+	// DB is the local state kept between jobs and across restarts.
+	DB *bolt.DB
+}
+
+// Factory builds a processor for a publisher.
+type Factory func(*Env) Processor
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory, 10)
+)
+
+// Register makes a processor available under the publisher name. Publisher
+// packages call it from init so importing the package is enough to route
+// messages to it. Registering the same name twice replaces the factory.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("publishers: Register factory is nil for " + name)
+	}
+	registry[name] = factory
+}
+
+// Lookup returns the factory registered under name.
+func Lookup(name string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	factory, ok := registry[name]
+	return factory, ok
+}
+
+// New builds the processor registered under name.
+func New(name string, env *Env) (Processor, error) {
+	factory, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("publishers: no processor registered for (%s)", name)
+	}
+	return factory(env), nil
+}
+
+// Registered lists the names of all registered processors.
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,81 @@
+package publishers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/yewno/acquisition/services"
+)
+
+type nopProcessor struct {
+	env *Env
+}
+
+func (p *nopProcessor) Process(ctx context.Context, job *Job) Result {
+	return Result{Publisher: job.Publisher()}
+}
+
+func TestRegister(t *testing.T) {
+
+	Register("nop", func(env *Env) Processor { return &nopProcessor{env} })
+
+	env := &Env{Stats: NewStats()}
+	processor, err := New("nop", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := processor.(*nopProcessor); !ok || p.env != env {
+		t.Errorf("expected nop processor built with env, got %#v", processor)
+	}
+
+	if _, err := New("missing", env); err == nil {
+		t.Error("expected error for unregistered publisher")
+	}
+}
+
+func TestJobPublisher(t *testing.T) {
+
+	cases := map[string]string{
+		"files/pnas/113_26/pnas_113_26.xml.zip": "pnas",
+		"files/bmj/test.tar.gz":                 "bmj",
+		"test.tar.gz":                           "",
+	}
+
+	for key, expected := range cases {
+		msg := &services.SnsMessage{}
+		body := `{"Records":[{"s3":{"bucket":{"name":"yewno-ftp"},"object":{"key":"` + key + `","size":1}}}]}`
+		if err := json.Unmarshal([]byte(body), msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if publisher := NewJob("", msg).Publisher(); publisher != expected {
+			t.Errorf("%s: expected (%s) got (%s)", key, expected, publisher)
+		}
+	}
+}
+
+func TestDirectJob(t *testing.T) {
+
+	job := NewDirectJob("yewno-ftp", "files/bmj/x.tar.gz", 10)
+	if job.Bucket() != "yewno-ftp" || job.Key() != "files/bmj/x.tar.gz" || job.Size() != 10 || job.Publisher() != "bmj" {
+		t.Errorf("unexpected job %+v", job.Message)
+	}
+	if job.Redelivered() {
+		t.Error("a direct job isn't redelivered")
+	}
+	job.Resend = true
+	if !job.Redelivered() {
+		t.Error("expected a job asking to resend to send unchanged pairs")
+	}
+
+	queue := &MockQueue{}
+	direct := &DirectQueue{CobaltQueue: queue}
+	direct.Pop(context.Background(), "new", job.Receipt)
+	batch := direct.NewBatch(context.Background(), "processed")
+	batch.Add("pair")
+	batch.Flush()
+	if len(queue.Popped) != 0 || len(queue.Messages) != 1 {
+		t.Errorf("expected sends only, popped %v sent %v", queue.Popped, queue.Messages)
+	}
+}
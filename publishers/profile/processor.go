@@ -0,0 +1,269 @@
+package profile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+
+	"github.com/yewno/acquisition/config"
+	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/publishers/archive"
+	"github.com/yewno/acquisition/publishers/manifest"
+	"github.com/yewno/acquisition/publishers/orphans"
+	"github.com/yewno/acquisition/services"
+)
+
+// Object processes deliveries for any publisher described by a Profile.
+type Object struct {
+	profile *Profile
+
+	conn  services.CobaltStorage
+	queue services.CobaltQueue
+	cfg   *config.Config
+
+	stats   *publishers.Stats
+	orphans *orphans.Ledger
+}
+
+func NewObject(profile *Profile, env *publishers.Env) *Object {
+	return &Object{
+		profile: profile,
+
+		conn:  env.Storage,
+		queue: env.Queue,
+		cfg:   env.Config,
+
+		stats:   env.Stats,
+		orphans: orphans.New(env.DB, profile.Name),
+	}
+}
+
+func (o *Object) Process(ctx context.Context, job *publishers.Job) publishers.Result {
+	count, err := o.process(ctx, job)
+	return publishers.Result{Publisher: o.profile.Name, Pairs: count, Err: err}
+}
+
+// Sweep reports the orphans that waited too long for their pair.
+func (o *Object) Sweep(ctx context.Context) []publishers.Result {
+	if err := o.orphans.Sweep(o.cfg.OrphanAge, o.stats); err != nil {
+		return []publishers.Result{{Publisher: o.profile.Name, Err: err}}
+	}
+	return nil
+}
+
+// saved is an entry of an archive and the outcome of its upload.
+type saved struct {
+	name   string
+	class  publishers.Class
+	object *services.Object
+	err    error
+}
+
+func (o *Object) process(ctx context.Context, job *publishers.Job) (int, error) {
+
+	var (
+		bucket = job.Bucket()
+		key    = job.Key()
+		size   = job.Size()
+		items  = make([]publishers.Item, 0, 100)
+	)
+
+	log.Println(bucket, key, size)
+	archiveFilename := key
+	archiveName := archive.Stem(key)
+
+	pairer, err := o.profile.NewPairer()
+	if err != nil {
+		return 0, err
+	}
+	inspector, _ := pairer.(publishers.Inspector)
+
+	object := services.NewObject(nil, bucket, key, size)
+
+	reader, err := publishers.OpenArchive(ctx, o.conn, object)
+	defer object.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	record := manifest.New(o.profile.Name, key)
+	if err := record.Source(object); err != nil {
+		log.Println(err)
+	}
+
+	reader = archive.Nested(reader, o.profile.Nested)
+	defer reader.Close()
+
+	o.stats.Archive <- 1
+
+	uploads := publishers.NewUploads(publishers.Concurrency(o.cfg, o.profile.Name, o.profile.Concurrency))
+	entries := make([]*saved, 0, 100)
+	compression := publishers.Compression(o.cfg, o.profile.Name, o.profile.Compression)
+
+	// a failed read leaves the rest of the archive out, the entries
+	// uploaded so far are waited for before failing
+	var failed error
+	for ctx.Err() == nil {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println(archiveFilename, err)
+			failed = err
+			break
+		}
+
+		name := entry.Name
+		class := o.profile.Classify(name)
+		base, _ := pairer.Base(name)
+
+		key, err := o.profile.ObjectKey(class, &KeyData{
+			Archive: archiveName,
+			Name:    name,
+			File:    path.Base(name),
+			Group:   base,
+		})
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		body, err := publishers.Inspect(inspector, name, entry)
+		if err != nil {
+			log.Printf("%s/%s: %v", archiveFilename, name, err)
+			failed = err
+			break
+		}
+
+		s := &saved{name: name, class: class, object: services.NewObject(nil, o.cfg.ProcessedBucket, key, 0)}
+		s.object.Compression = compression
+		s.object.Tags = publishers.Tags(o.profile.Name, archiveFilename, class)
+		err = uploads.Go(body, func(body io.Reader) {
+			s.err = s.object.SaveStream(ctx, o.conn, body)
+		})
+		if err != nil {
+			s.err = err
+		}
+		entries = append(entries, s)
+	}
+	uploads.Wait()
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	// an archive that isn't read through, or an entry that isn't stored,
+	// can't be announced, the message comes back to try the archive again
+	for _, s := range entries {
+		if s.err != nil {
+			log.Printf("%s/%s: %v", archiveFilename, s.name, s.err)
+			failed = s.err
+		}
+	}
+	if failed != nil {
+		return 0, failed
+	}
+
+	// stats and pairing follow the order of the archive, whatever order
+	// the uploads finished in
+	for _, s := range entries {
+		if s.object.Unchanged {
+			o.stats.Skipped <- 1
+		}
+		record.Add(archiveFilename, s.name, s.object, s.class)
+
+		switch s.class {
+		case publishers.Content:
+			o.stats.Content <- 1
+		case publishers.Meta:
+			o.stats.Meta <- 1
+		default:
+			o.stats.Other <- 1
+		}
+
+		items = append(items, publishers.Item{Name: s.name, Key: s.object.Key, Class: s.class, Unchanged: s.object.Unchanged})
+	}
+
+	pairs, unpaired := publishers.MakePairs(pairer, items)
+	for _, item := range unpaired {
+		o.stats.ProblemFilenames <- fmt.Sprintf("%s/%s", archiveFilename, item.Name)
+	}
+	if reporter, ok := pairer.(publishers.Reporter); ok {
+		for _, problem := range reporter.Problems() {
+			o.stats.ProblemFilenames <- fmt.Sprintf("%s/%s", archiveFilename, problem)
+		}
+	}
+
+	if _, err := o.orphans.Match(archiveFilename, pairs); err != nil {
+		log.Println(err)
+	}
+
+	record.Pairs(pairs, unpaired)
+	unchanged := publishers.Unchanged(items)
+	if job.Redelivered() {
+		unchanged = nil
+	}
+
+	var sendErr error
+	batch := o.queue.NewBatch(ctx, o.cfg.ProcessedQueue)
+	count := 0
+	for _, p := range pairs {
+		if p.Meta != "" && p.Content != "" {
+			if unchanged[p.Meta] && unchanged[p.Content] {
+				o.stats.SkippedPairs <- 1
+				continue
+			}
+			m := &services.PairMessage{
+				Source:  o.profile.Source,
+				Bucket:  o.cfg.ProcessedBucket,
+				Key:     p.Content,
+				MetaKey: p.Meta,
+			}
+			if err := batch.Add(m); err != nil {
+				log.Println(err)
+				sendErr = err
+				continue
+			}
+			count++
+			o.stats.Pairs <- 1
+			record.Sent(m)
+		} else {
+			var key string
+			if p.Meta == "" {
+				o.stats.MissingMeta <- 1
+				key = p.Content
+			} else {
+				o.stats.MissingContent <- 1
+				key = p.Meta
+			}
+			o.stats.ProblemFilenames <- fmt.Sprintf("%s/%s", archiveFilename, key)
+		}
+	}
+	o.stats.Report <- fmt.Sprintf("%s:%d", o.profile.Name, count)
+	if err := batch.Flush(); err != nil {
+		// the message isn't deleted, it comes back to send the pairs again
+		log.Println(err)
+		return count, err
+	}
+	if sendErr != nil {
+		return count, sendErr
+	}
+	if err := o.orphans.Release(pairs); err != nil {
+		log.Println(err)
+	}
+	if ctx.Err() != nil {
+		return count, ctx.Err()
+	}
+
+	if err := record.Save(ctx, o.conn, o.cfg.ProcessedBucket, o.cfg.ManifestPrefix); err != nil {
+		log.Println(err)
+	}
+
+	if err := o.queue.Pop(ctx, o.cfg.NewContentQueue, job.Receipt); err != nil {
+		log.Println(err)
+		return count, err
+	}
+	return count, nil
+}
@@ -0,0 +1,433 @@
+package profile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/config"
+	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/services"
+)
+
+func writeTarGz(t *testing.T, filename string, entries map[string]string) {
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		body := entries[name]
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fixture processes bmj archives written to its ftp bucket. Tests set
+// errors on its storage and queue, or change its config, before processing.
+type fixture struct {
+	ftp       string
+	processed string
+	obj       *Object
+	storage   *publishers.MockStorage
+	queue     *publishers.MockQueue
+	stats     *publishers.Stats
+	cfg       *config.Config
+}
+
+func newFixture(t *testing.T) *fixture {
+
+	dir := t.TempDir()
+
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	p, err := Load("../../profiles/bmj.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fixture{
+		ftp:       filepath.Join(dir, "ftp"),
+		processed: filepath.Join(dir, "processed"),
+		storage:   &publishers.MockStorage{},
+		queue:     &publishers.MockQueue{},
+		stats:     publishers.NewStats(),
+	}
+	f.cfg = &config.Config{
+		ProcessedBucket: f.processed,
+		ProcessedQueue:  "processQueue",
+		NewContentQueue: "newContentQueue",
+	}
+	f.obj = NewObject(p, &publishers.Env{
+		Storage: f.storage,
+		Queue:   f.queue,
+		Config:  f.cfg,
+		Stats:   f.stats,
+		DB:      db,
+	})
+	return f
+}
+
+// job is the message of the archive under key, received attempts times.
+func (f *fixture) job(t *testing.T, key string, attempts int) *publishers.Job {
+
+	msg := &services.SnsMessage{}
+	err := json.Unmarshal([]byte(fmt.Sprintf(
+		`{"Records":[{"s3":{"bucket":{"name":"%s"},"object":{"key":"%s","size":%d}}}]}`,
+		f.ftp, key, 1,
+	)), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := publishers.NewJob("foo", msg)
+	job.Attempts = attempts
+	return job
+}
+
+func (f *fixture) process(t *testing.T, key string) publishers.Result {
+	return f.obj.Process(context.Background(), f.job(t, key, 1))
+}
+
+// pairs are the content keys of the pairs sent by meta key.
+func (f *fixture) pairs(t *testing.T) map[string]string {
+	pairs := make(map[string]string, len(f.queue.Messages))
+	for _, body := range f.queue.Messages {
+		m := &services.PairMessage{}
+		if err := json.Unmarshal([]byte(body), m); err != nil {
+			t.Fatal(err)
+		}
+		pairs[m.MetaKey] = m.Key
+	}
+	return pairs
+}
+
+func TestProcess(t *testing.T) {
+
+	f := newFixture(t)
+	writeTarGz(t, filepath.Join(f.ftp, "files/bmj/test.tar.gz"), map[string]string{
+		"bmj.1.pdf": "pdf",
+		"bmj.1.xml": "<article/>",
+		"bmj2.pdf":  "pdf",
+		"bmj2.jpg":  "jpg",
+	})
+
+	result := f.process(t, "files/bmj/test.tar.gz")
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if result.Pairs != 1 || len(f.queue.Messages) != 1 {
+		t.Fatalf("expected 1 pair, got %d %v", result.Pairs, f.queue.Messages)
+	}
+
+	m := &services.PairMessage{}
+	if err := json.Unmarshal([]byte(f.queue.Messages[0]), m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Source != "bmj" || m.Key != "bmj/bmj.1.pdf" || m.MetaKey != "bmj/bmj.1.xml.gz" {
+		t.Errorf("unexpected pair %+v", m)
+	}
+
+	for _, key := range []string{"bmj/bmj.1.pdf", "bmj/bmj.1.xml.gz", "bmj/bmj2.pdf", "bmj/bmj2.jpg"} {
+		if _, err := os.Stat(filepath.Join(f.processed, key)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestProcessDottedNames(t *testing.T) {
+
+	// articles named alike up to their first dot don't collide
+	f := newFixture(t)
+	writeTarGz(t, filepath.Join(f.ftp, "files/bmj/test.tar.gz"), map[string]string{
+		"bmj.i123.pdf": "pdf",
+		"bmj.i123.xml": "<article/>",
+		"bmj.i456.pdf": "pdf",
+		"bmj.i456.xml": "<article/>",
+	})
+
+	if result := f.process(t, "files/bmj/test.tar.gz"); result.Err != nil || result.Pairs != 2 {
+		t.Fatalf("expected 2 pairs, got %v %v", result, f.queue.Messages)
+	}
+	expected := map[string]string{
+		"bmj/bmj.i123.xml.gz": "bmj/bmj.i123.pdf",
+		"bmj/bmj.i456.xml.gz": "bmj/bmj.i456.pdf",
+	}
+	if pairs := f.pairs(t); !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+}
+
+func TestProcessLateArrival(t *testing.T) {
+
+	f := newFixture(t)
+	writeTarGz(t, filepath.Join(f.ftp, "files/bmj/1.tar.gz"), map[string]string{"bmj2.pdf": "pdf"})
+	writeTarGz(t, filepath.Join(f.ftp, "files/bmj/2.tar.gz"), map[string]string{"bmj2.xml": "<article/>"})
+
+	for i, key := range []string{"files/bmj/1.tar.gz", "files/bmj/2.tar.gz"} {
+		result := f.process(t, key)
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		if result.Pairs != i {
+			t.Fatalf("%s: expected %d pairs, got %d", key, i, result.Pairs)
+		}
+	}
+
+	if pairs := f.pairs(t); pairs["bmj/bmj2.xml.gz"] != "bmj/bmj2.pdf" {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+}
+
+func TestProcessLateArrivalSendFailure(t *testing.T) {
+
+	f := newFixture(t)
+	writeTarGz(t, filepath.Join(f.ftp, "files/bmj/1.tar.gz"), map[string]string{"bmj2.pdf": "pdf"})
+	writeTarGz(t, filepath.Join(f.ftp, "files/bmj/2.tar.gz"), map[string]string{"bmj2.xml": "<article/>"})
+
+	if result := f.process(t, "files/bmj/1.tar.gz"); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	f.queue.SendErr = errors.New("down")
+	if result := f.process(t, "files/bmj/2.tar.gz"); result.Err == nil {
+		t.Fatalf("expected the send to fail, got %v", result)
+	}
+
+	// the retry still finds the pdf waiting for its xml
+	f.queue.SendErr = nil
+	result := f.obj.Process(context.Background(), f.job(t, "files/bmj/2.tar.gz", 2))
+	if result.Err != nil || result.Pairs != 1 || len(f.queue.Messages) != 1 {
+		t.Fatalf("expected 1 pair, got %v %v", result, f.queue.Messages)
+	}
+	if pairs := f.pairs(t); pairs["bmj/bmj2.xml.gz"] != "bmj/bmj2.pdf" {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+}
+
+func TestProcessRedelivery(t *testing.T) {
+
+	f := newFixture(t)
+	for _, key := range []string{"files/bmj/1.tar.gz", "files/bmj/1-again.tar.gz"} {
+		writeTarGz(t, filepath.Join(f.ftp, key), map[string]string{
+			"bmj1.pdf": "pdf",
+			"bmj1.xml": "<article/>",
+			"bmj2.pdf": "pdf",
+			"bmj2.xml": "<article/>",
+		})
+	}
+	writeTarGz(t, filepath.Join(f.ftp, "files/bmj/2.tar.gz"), map[string]string{
+		"bmj1.pdf": "pdf",
+		"bmj1.xml": "<article/>",
+		"bmj2.pdf": "pdf",
+		"bmj2.xml": "<article>corrected</article>",
+	})
+
+	for _, key := range []string{"files/bmj/1.tar.gz", "files/bmj/1-again.tar.gz", "files/bmj/2.tar.gz"} {
+		if result := f.process(t, key); result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+
+	// the first delivery twice, then only the corrected article
+	if len(f.queue.Messages) != 3 {
+		t.Fatalf("expected 3 pairs, got %v", f.queue.Messages)
+	}
+	if len(f.stats.Skipped) != 7 || len(f.stats.SkippedPairs) != 3 {
+		t.Errorf("expected 7 skipped uploads and 3 skipped pairs, got %d and %d", len(f.stats.Skipped), len(f.stats.SkippedPairs))
+	}
+
+	m := &services.PairMessage{}
+	if err := json.Unmarshal([]byte(f.queue.Messages[2]), m); err != nil {
+		t.Fatal(err)
+	}
+	if m.MetaKey != "bmj/bmj2.xml.gz" {
+		t.Errorf("unexpected pair %+v", m)
+	}
+}
+
+func TestProcessCancelled(t *testing.T) {
+
+	f := newFixture(t)
+	for _, key := range []string{"files/bmj/1.tar.gz", "files/bmj/1-again.tar.gz"} {
+		writeTarGz(t, filepath.Join(f.ftp, key), map[string]string{
+			"bmj1.pdf": "pdf",
+			"bmj1.xml": "<article/>",
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result := f.obj.Process(ctx, f.job(t, "files/bmj/1.tar.gz", 1)); result.Err == nil {
+		t.Fatal("expected a cancelled job to fail")
+	}
+	if len(f.queue.Popped) != 0 || len(f.queue.Messages) != 0 {
+		t.Fatalf("cancelled job popped %v and sent %v", f.queue.Popped, f.queue.Messages)
+	}
+
+	if result := f.process(t, "files/bmj/1.tar.gz"); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	// the redelivered job sends its pair although nothing changed, an
+	// earlier attempt may have stopped before sending it
+	if result := f.obj.Process(context.Background(), f.job(t, "files/bmj/1-again.tar.gz", 2)); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if len(f.queue.Messages) != 2 {
+		t.Errorf("expected the pair twice, got %v", f.queue.Messages)
+	}
+}
+
+func TestProcessSendFailure(t *testing.T) {
+
+	// the batch fails to send, or to take the pair at all, say when its
+	// claim check can't be stored
+	for _, queue := range []publishers.MockQueue{
+		{SendErr: errors.New("sqs unavailable")},
+		{AddErr: errors.New("claim check not stored")},
+	} {
+		f := newFixture(t)
+		f.queue.SendErr, f.queue.AddErr = queue.SendErr, queue.AddErr
+		writeTarGz(t, filepath.Join(f.ftp, "files/bmj/1.tar.gz"), map[string]string{
+			"bmj1.pdf": "pdf",
+			"bmj1.xml": "<article/>",
+		})
+
+		if result := f.process(t, "files/bmj/1.tar.gz"); result.Err == nil {
+			t.Fatal("expected the send failure")
+		}
+		if len(f.queue.Popped) != 0 {
+			t.Errorf("message deleted although its pair wasn't sent: %v", f.queue.Popped)
+		}
+	}
+}
+
+func TestProcessUploadFailure(t *testing.T) {
+
+	f := newFixture(t)
+	f.storage.UploadErr = errors.New("s3 unavailable")
+	writeTarGz(t, filepath.Join(f.ftp, "files/bmj/1.tar.gz"), map[string]string{
+		"bmj1.pdf": "pdf",
+		"bmj1.xml": "<article/>",
+	})
+
+	if result := f.process(t, "files/bmj/1.tar.gz"); result.Err == nil {
+		t.Fatal("expected the upload failure")
+	}
+	if len(f.queue.Messages) != 0 || len(f.queue.Popped) != 0 {
+		t.Errorf("pair announced or message deleted without its entries stored: %v %v", f.queue.Messages, f.queue.Popped)
+	}
+}
+
+func TestProcessRangeFailure(t *testing.T) {
+
+	f := newFixture(t)
+	f.storage.RangeErr = errors.New("connection reset")
+	f.storage.RangeLimit = 3
+
+	// a zip read in place over three 1MB blocks: the magic, the directory
+	// in the last block and the first block are read, the second fails
+	// in the middle of the xml
+	filename := filepath.Join(f.ftp, "files/bmj/1.zip")
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := zip.NewWriter(file)
+	for name, body := range map[string]string{
+		"bmj1.pdf": "pdf",
+		"bmj1.xml": "<article>" + strings.Repeat("a", 5*1024*1024/2) + "</article>",
+	} {
+		w, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(w, body)
+	}
+	writer.Close()
+	file.Close()
+
+	if result := f.process(t, "files/bmj/1.zip"); result.Err == nil {
+		t.Fatal("expected the read failure")
+	}
+	if f.storage.Ranges != 3 {
+		t.Errorf("expected the read to fail partway, after %d ranges", f.storage.Ranges)
+	}
+	if len(f.queue.Popped) != 0 {
+		t.Errorf("message deleted although the archive wasn't read: %v", f.queue.Popped)
+	}
+}
+
+func TestProcessConcurrent(t *testing.T) {
+
+	entries := make(map[string]string, 40)
+	for i := 0; i < 20; i++ {
+		entries[fmt.Sprintf("bmj%d.pdf", i)] = "pdf"
+		entries[fmt.Sprintf("bmj%d.xml", i)] = "<article/>"
+	}
+
+	// a concurrent run pairs like a sequential one
+	sent := make([]map[string]string, 0, 2)
+	for _, concurrency := range []int{1, 4} {
+		f := newFixture(t)
+		f.cfg.UploadConcurrency = concurrency
+		writeTarGz(t, filepath.Join(f.ftp, "files/bmj/1.tar.gz"), entries)
+
+		result := f.process(t, "files/bmj/1.tar.gz")
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		if result.Pairs != 20 {
+			t.Fatalf("concurrency %d: expected 20 pairs, got %d", concurrency, result.Pairs)
+		}
+		sent = append(sent, f.pairs(t))
+	}
+
+	if !reflect.DeepEqual(sent[0], sent[1]) {
+		t.Errorf("pairs differ: %v, %v", sent[0], sent[1])
+	}
+}
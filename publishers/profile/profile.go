@@ -0,0 +1,281 @@
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"text/template"
+
+	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/services"
+)
+
+// Pairing rules a profile can declare, see the pairers of the same name in
+// the publishers package.
+const (
+	Basename  = "basename"
+	Prefix    = "prefix"
+	Directory = "directory"
+	Regex     = "regex"
+	Manifest  = "manifest"
+	JATS      = "jats"
+)
+
+// Profile describes a publisher whose deliveries follow a conventional
+// layout: an archive of content and meta files that pair up by name. The
+// archive format is detected, see the archive package.
+//
+//	{
+//	  "name": "bmj",
+//	  "source": "bmj",
+//	  "key": "bmj/{{.Name}}",
+//	  "pairing": {"rule": "basename"},
+//	  "content": [".pdf"],
+//	  "meta": [".xml"]
+//	}
+//
+// Key templates are rendered with the fields of KeyData.
+type Profile struct {
+	// Name is the routing key, the directory under files/ the publisher uploads to.
+	Name string `json:"name"`
+	// Source is sent on every PairMessage. Defaults to Name.
+	Source string `json:"source"`
+
+	// Key is the template for the processed key of every entry.
+	Key string `json:"key"`
+	// OtherKey, if set, is used instead of Key for entries that are
+	// neither content nor meta.
+	OtherKey string `json:"other_key"`
+
+	Pairing Pairing `json:"pairing"`
+
+	Content []string `json:"content"`
+	Meta    []string `json:"meta"`
+
+	// Nested is how many levels of archives inside a delivery are expanded,
+	// zero uploads inner archives as they are.
+	Nested int `json:"nested,omitempty"`
+
+	// Concurrency is how many entries are uploaded at a time, zero leaves
+	// it to -upload-concurrency.
+	Concurrency int `json:"concurrency,omitempty"`
+	// Compression maps extensions to the codec entries with the extension
+	// are stored with, left out it is -compression.
+	Compression map[string]string `json:"compression,omitempty"`
+
+	key      *template.Template
+	otherKey *template.Template
+}
+
+// Pairing is the rule used to find the base two entries pair on.
+type Pairing struct {
+	Rule string `json:"rule"`
+	// Length of a prefix rule.
+	Length int `json:"length,omitempty"`
+	// Segment of a directory rule.
+	Segment int `json:"segment,omitempty"`
+	// Pattern of a regex rule, the first capture group is the base.
+	Pattern string `json:"pattern,omitempty"`
+	// Manifest is the file name of the manifest of a manifest rule.
+	Manifest string `json:"manifest,omitempty"`
+	// Fallback is used by manifest and jats rules for entries they can't
+	// place themselves.
+	Fallback *Pairing `json:"fallback,omitempty"`
+}
+
+// NewPairer builds the pairer for the rule. Pairers may keep state for the
+// archive they pair so every archive needs a new one.
+func (p *Pairing) NewPairer() (publishers.Pairer, error) {
+
+	switch p.Rule {
+	case Basename:
+		return publishers.Basename{}, nil
+
+	case Prefix:
+		if p.Length <= 0 {
+			return nil, fmt.Errorf("prefix pairing needs a length")
+		}
+		return publishers.Prefix{Length: p.Length}, nil
+
+	case Directory:
+		return publishers.Directory{Segment: p.Segment}, nil
+
+	case Regex:
+		return publishers.NewRegex(p.Pattern)
+
+	case Manifest:
+		if p.Manifest == "" {
+			return nil, fmt.Errorf("manifest pairing needs a manifest file name")
+		}
+		fallback, err := p.fallback()
+		if err != nil {
+			return nil, err
+		}
+		return &publishers.Manifest{Filename: p.Manifest, Fallback: fallback}, nil
+
+	case JATS:
+		fallback, err := p.fallback()
+		if err != nil {
+			return nil, err
+		}
+		return &publishers.JATS{Fallback: fallback}, nil
+	}
+	return nil, fmt.Errorf("unknown pairing rule (%s)", p.Rule)
+}
+
+func (p *Pairing) fallback() (publishers.Pairer, error) {
+	if p.Fallback == nil {
+		return nil, nil
+	}
+	return p.Fallback.NewPairer()
+}
+
+// KeyData is what key templates are rendered with.
+type KeyData struct {
+	// Archive is the file name of the delivery without its extension.
+	Archive string
+	// Name is the full path of the entry inside the archive.
+	Name string
+	// File is the file name of the entry.
+	File string
+	// Group is the base the entry pairs on.
+	Group string
+}
+
+// Load reads and validates a single profile.
+func Load(filename string) (*Profile, error) {
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Profile{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if err := p.init(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return p, nil
+}
+
+// LoadDir loads every *.json profile in dir.
+func LoadDir(dir string) ([]*Profile, error) {
+
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(filenames) == 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	profiles := make([]*Profile, 0, len(filenames))
+	for _, filename := range filenames {
+		p, err := Load(filename)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// Register makes the profile available as a processor under its name.
+func (p *Profile) Register() {
+	publishers.Register(p.Name, func(env *publishers.Env) publishers.Processor {
+		return NewObject(p, env)
+	})
+}
+
+func (p *Profile) init() error {
+	var err error
+
+	if p.Name == "" {
+		return fmt.Errorf("profile is missing a name")
+	}
+	if p.Source == "" {
+		p.Source = p.Name
+	}
+
+	if _, err := p.NewPairer(); err != nil {
+		return err
+	}
+
+	if p.Nested < 0 {
+		return fmt.Errorf("nested depth can't be negative")
+	}
+
+	if len(p.Content) == 0 || len(p.Meta) == 0 {
+		return fmt.Errorf("profile needs content and meta extensions")
+	}
+
+	if err := services.Compression(p.Compression).Validate(); err != nil {
+		return err
+	}
+
+	if p.key, err = template.New("key").Parse(p.Key); err != nil {
+		return err
+	}
+	p.otherKey = p.key
+	if p.OtherKey != "" {
+		if p.otherKey, err = template.New("other_key").Parse(p.OtherKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewPairer builds the pairer of the profile for a new archive.
+func (p *Profile) NewPairer() (publishers.Pairer, error) {
+
+	pairer, err := p.Pairing.NewPairer()
+	if err != nil {
+		return nil, err
+	}
+	if jats, ok := pairer.(*publishers.JATS); ok {
+		jats.Meta = p.Meta
+		jats.Content = p.Content
+	}
+	return pairer, nil
+}
+
+// Classify reports whether name is content, meta or other by its extension.
+func (p *Profile) Classify(name string) publishers.Class {
+
+	ext := path.Ext(name)
+	for _, e := range p.Content {
+		if ext == e {
+			return publishers.Content
+		}
+	}
+	for _, e := range p.Meta {
+		if ext == e {
+			return publishers.Meta
+		}
+	}
+	return publishers.Other
+}
+
+// ObjectKey renders the processed key of an entry.
+func (p *Profile) ObjectKey(class publishers.Class, data *KeyData) (string, error) {
+
+	tmpl := p.key
+	if class == publishers.Other {
+		tmpl = p.otherKey
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,110 @@
+package profile
+
+import (
+	"testing"
+
+	"github.com/yewno/acquisition/publishers"
+)
+
+func TestLoadShippedProfiles(t *testing.T) {
+
+	profiles, err := LoadDir("../../profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]bool, len(profiles))
+	for _, p := range profiles {
+		names[p.Name] = true
+	}
+	for _, name := range []string{"bmj", "cup", "oup", "tandf"} {
+		if !names[name] {
+			t.Errorf("missing profile for (%s)", name)
+		}
+	}
+}
+
+func TestNewPairer(t *testing.T) {
+
+	cases := []struct {
+		pairing Pairing
+		name    string
+		base    string
+		ok      bool
+	}{
+		{Pairing{Rule: Basename}, "bmj/bmj.i123.pdf", "bmj.i123", true},
+		{Pairing{Rule: Prefix, Length: 17}, "issue/S0022112016001234a.pdf", "S0022112016001234", true},
+		{Pairing{Rule: Directory, Segment: 1}, "issue/10.1080.123/article.pdf", "10.1080.123", true},
+		{Pairing{Rule: Regex, Pattern: `^(.+)\.(?:pdf|xml)$`}, "pnas.1.pdf", "pnas.1", true},
+		{Pairing{Rule: Manifest, Manifest: "manifest.csv", Fallback: &Pairing{Rule: Basename}}, "a/abc.pdf", "abc", true},
+		{Pairing{Rule: Manifest, Manifest: "manifest.csv"}, "a/abc.pdf", "", false},
+	}
+
+	for _, c := range cases {
+		pairer, err := c.pairing.NewPairer()
+		if err != nil {
+			t.Errorf("%s: %v", c.pairing.Rule, err)
+			continue
+		}
+		base, ok := pairer.Base(c.name)
+		if base != c.base || ok != c.ok {
+			t.Errorf("%s %s: expected (%s, %v) got (%s, %v)", c.pairing.Rule, c.name, c.base, c.ok, base, ok)
+		}
+	}
+
+	for _, pairing := range []Pairing{
+		{Rule: "stem"},
+		{Rule: Prefix},
+		{Rule: Regex, Pattern: `no group`},
+		{Rule: Manifest},
+		{Rule: Manifest, Manifest: "manifest.csv", Fallback: &Pairing{Rule: Prefix}},
+	} {
+		if _, err := pairing.NewPairer(); err == nil {
+			t.Errorf("expected error for %+v", pairing)
+		}
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+
+	p := &Profile{
+		Name:     "tandf",
+		Key:      "tandf/{{.File}}",
+		OtherKey: "tandf/{{.Group}}/{{.File}}",
+		Pairing:  Pairing{Rule: Directory, Segment: 1},
+		Content:  []string{".pdf"},
+		Meta:     []string{".xml"},
+	}
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := &KeyData{Archive: "issue", Name: "issue/123/a.pdf", File: "a.pdf", Group: "123"}
+	if key, _ := p.ObjectKey(p.Classify(data.Name), data); key != "tandf/a.pdf" {
+		t.Errorf("unexpected content key (%s)", key)
+	}
+
+	data = &KeyData{Archive: "issue", Name: "issue/123/f1.jpg", File: "f1.jpg", Group: "123"}
+	if key, _ := p.ObjectKey(p.Classify(data.Name), data); key != "tandf/123/f1.jpg" {
+		t.Errorf("unexpected other key (%s)", key)
+	}
+
+	if p.Source != "tandf" {
+		t.Errorf("expected source to default to name, got (%s)", p.Source)
+	}
+}
+
+func TestClassify(t *testing.T) {
+
+	p := &Profile{Content: []string{".pdf"}, Meta: []string{".xml"}}
+
+	for name, class := range map[string]publishers.Class{
+		"a.pdf": publishers.Content,
+		"a.xml": publishers.Meta,
+		"a.jpg": publishers.Other,
+	} {
+		if c := p.Classify(name); c != class {
+			t.Errorf("%s: expected %d got %d", name, class, c)
+		}
+	}
+}
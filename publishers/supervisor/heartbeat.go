@@ -0,0 +1,57 @@
+package supervisor
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/yewno/acquisition/services"
+)
+
+// Heartbeat keeps the message of a running job invisible to other consumers
+// by extending its visibility timeout before it runs out.
+type Heartbeat struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Beat hides the message for timeout right away and again every half
+// timeout until Stop is called.
+func Beat(queue services.CobaltQueue, name, receipt string, timeout time.Duration) *Heartbeat {
+
+	if timeout > MaxBackoff {
+		timeout = MaxBackoff
+	}
+
+	h := &Heartbeat{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(h.done)
+
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+
+		for {
+			if err := queue.ExtendVisibility(context.Background(), name, receipt, timeout); err != nil {
+				log.Println(err)
+			}
+
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return h
+}
+
+// Stop ends the heartbeat. It waits for an extension in flight so it can't
+// undo a visibility set after Stop returns.
+func (h *Heartbeat) Stop() {
+	close(h.stop)
+	<-h.done
+}
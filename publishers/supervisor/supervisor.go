@@ -0,0 +1,241 @@
+// Package supervisor runs jobs, keeping their messages hidden while they
+// run, and decides what happens to the message of a job that failed: it is
+// retried with exponential backoff, and after too many attempts it is sent
+// to a dead letter queue and deleted, instead of coming back forever.
+package supervisor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/services"
+)
+
+// Defaults for a zero Policy.
+const (
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = time.Minute
+	// MaxBackoff is the longest SQS keeps a message invisible.
+	MaxBackoff = 12 * time.Hour
+)
+
+var errorsBucket = []byte("supervisor/errors")
+
+// Policy is how running jobs are kept and failed jobs are retried.
+type Policy struct {
+	// Visibility is how long the message of a running job is hidden at a
+	// time, zero leaves it to the queue's visibility timeout.
+	Visibility time.Duration
+
+	// MaxAttempts is how many times a job is tried before it is dead
+	// lettered.
+	MaxAttempts int
+	// Backoff is how long a job stays invisible after its first failure,
+	// doubling with every further one.
+	Backoff time.Duration
+}
+
+// Supervisor runs the jobs of messages received from the source queue.
+type Supervisor struct {
+	queue  services.CobaltQueue
+	source string
+	// deadLetter is the name of the dead letter queue, empty leaves
+	// messages to the queue's own redrive policy.
+	deadLetter string
+	policy     Policy
+
+	// db keeps the errors of earlier attempts, optional.
+	db *bolt.DB
+}
+
+// New returns a supervisor for messages received from the source queue.
+func New(queue services.CobaltQueue, source, deadLetter string, policy Policy, db *bolt.DB) *Supervisor {
+
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultMaxAttempts
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = DefaultBackoff
+	}
+
+	return &Supervisor{
+		queue:      queue,
+		source:     source,
+		deadLetter: deadLetter,
+		policy:     policy,
+		db:         db,
+	}
+}
+
+// Run processes the job of message, keeping the message hidden while it
+// runs. Processors delete the message when they succeed, a failure is
+// handed to Failed. A job cancelled by ctx didn't fail, its message is
+// made visible again for redelivery.
+func (s *Supervisor) Run(ctx context.Context, processor publishers.Processor, job *publishers.Job, message *services.Message) publishers.Result {
+
+	var heartbeat *Heartbeat
+	if s.policy.Visibility > 0 {
+		heartbeat = Beat(s.queue, s.source, message.Receipt, s.policy.Visibility)
+	}
+
+	result := processor.Process(ctx, job)
+	if heartbeat != nil {
+		heartbeat.Stop()
+	}
+
+	if result.Err != nil && ctx.Err() != nil {
+		log.Printf("%s: %s: cancelled, left for redelivery", result.Publisher, job.Key())
+		if err := s.queue.ExtendVisibility(context.Background(), s.source, message.Receipt, 0); err != nil {
+			log.Println(err)
+		}
+		return result
+	}
+
+	if result.Err != nil {
+		s.Failed(message, job, result.Err)
+		return result
+	}
+
+	s.forget(message)
+	return result
+}
+
+// Failed records a failed attempt at message. The message is hidden for the
+// backoff of the attempt, or dead lettered and deleted once it has used up
+// its attempts. job may be nil for messages that couldn't be parsed.
+//
+// The queue calls aren't cancelled with the job, an attempt is accounted
+// for even during shutdown.
+func (s *Supervisor) Failed(message *services.Message, job *publishers.Job, err error) {
+
+	ctx := context.Background()
+
+	attempts := message.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	errs := s.record(message, fmt.Sprintf("attempt %d: %v", attempts, err))
+
+	if attempts < s.policy.MaxAttempts {
+		backoff := s.Backoff(attempts)
+		if err := s.queue.ExtendVisibility(ctx, s.source, message.Receipt, backoff); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if s.deadLetter == "" {
+		log.Printf("%s: gave up after %d attempts: %v", message.ID, attempts, err)
+		return
+	}
+
+	letter := &services.DeadLetter{
+		Body:     message.Body,
+		Attempts: attempts,
+		Errors:   errs,
+	}
+	if job != nil && len(job.Message.Records) > 0 {
+		letter.Publisher = job.Publisher()
+		letter.Key = job.Key()
+	}
+
+	batch := s.queue.NewBatch(ctx, s.deadLetter)
+	if err := batch.Add(letter); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := batch.Flush(); err != nil {
+		// the message stays for the queue's own redrive policy
+		log.Println(err)
+		return
+	}
+
+	if err := s.queue.Pop(ctx, s.source, message.Receipt); err != nil {
+		log.Println(err)
+		return
+	}
+	s.forget(message)
+}
+
+// Backoff is how long a message stays invisible after failing attempt.
+func (s *Supervisor) Backoff(attempt int) time.Duration {
+	backoff := s.policy.Backoff
+	for i := 1; i < attempt && backoff < MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxBackoff {
+		backoff = MaxBackoff
+	}
+	return backoff
+}
+
+// record adds the error to those of earlier attempts at the message and
+// returns them all.
+func (s *Supervisor) record(message *services.Message, e string) []string {
+
+	errs := []string{e}
+	if s.db == nil || message.ID == "" {
+		return errs
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(errorsBucket)
+		if err != nil {
+			return err
+		}
+
+		earlier := make([]string, 0)
+		if v := b.Get([]byte(message.ID)); v != nil {
+			if err := json.Unmarshal(v, &earlier); err != nil {
+				return err
+			}
+		}
+		errs = append(earlier, e)
+
+		v, err := json.Marshal(errs)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(message.ID), v)
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return errs
+}
+
+func (s *Supervisor) forget(message *services.Message) {
+
+	if s.db == nil || message.ID == "" {
+		return
+	}
+
+	// most jobs never failed, don't write for them
+	failed := false
+	s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(errorsBucket); b != nil {
+			failed = b.Get([]byte(message.ID)) != nil
+		}
+		return nil
+	})
+	if !failed {
+		return
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(errorsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(message.ID))
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,180 @@
+package supervisor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yewno/acquisition/publishers"
+	"github.com/yewno/acquisition/services"
+)
+
+type failing struct {
+	err error
+}
+
+func (f *failing) Process(ctx context.Context, job *publishers.Job) publishers.Result {
+	return publishers.Result{Publisher: "bmj", Err: f.err}
+}
+
+func openDB(t *testing.T) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newJob(t *testing.T, key string) *publishers.Job {
+	msg := &services.SnsMessage{}
+	body := fmt.Sprintf(`{"Records": [{"s3": {"bucket": {"name": "ftp"}, "object": {"key": %q, "size": 1}}}]}`, key)
+	if err := json.Unmarshal([]byte(body), msg); err != nil {
+		t.Fatal(err)
+	}
+	return publishers.NewJob("receipt", msg)
+}
+
+func TestBackoff(t *testing.T) {
+
+	s := New(&publishers.MockQueue{}, "new", "", Policy{Backoff: time.Minute}, nil)
+
+	expected := map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		3:  4 * time.Minute,
+		20: MaxBackoff,
+	}
+	for attempt, backoff := range expected {
+		if got := s.Backoff(attempt); got != backoff {
+			t.Errorf("attempt %d: expected %v got %v", attempt, backoff, got)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+
+	queue := &publishers.MockQueue{}
+	s := New(queue, "new", "dead", Policy{MaxAttempts: 3, Backoff: time.Minute}, openDB(t))
+
+	job := newJob(t, "files/bmj/1.zip")
+	processor := &failing{err: errors.New("broken archive")}
+
+	for attempt := 1; attempt < 3; attempt++ {
+		m := &services.Message{ID: "1", Receipt: "receipt", Attempts: attempt, Body: "{}"}
+		if result := s.Run(context.Background(), processor, job, m); result.Err == nil {
+			t.Fatal("expected the error of the processor")
+		}
+		if got := queue.Visibility["receipt"]; got != s.Backoff(attempt) {
+			t.Errorf("attempt %d: expected visibility %v got %v", attempt, s.Backoff(attempt), got)
+		}
+		if len(queue.Popped) != 0 || len(queue.Messages) != 0 {
+			t.Fatalf("attempt %d: message dead lettered early", attempt)
+		}
+	}
+
+	m := &services.Message{ID: "1", Receipt: "receipt", Attempts: 3, Body: "{}"}
+	s.Run(context.Background(), processor, job, m)
+
+	if len(queue.Popped) != 1 {
+		t.Errorf("expected the message to be deleted, popped %v", queue.Popped)
+	}
+	if len(queue.Messages) != 1 {
+		t.Fatalf("expected a dead letter, got %v", queue.Messages)
+	}
+
+	letter := &services.DeadLetter{}
+	if err := json.Unmarshal([]byte(queue.Messages[0]), letter); err != nil {
+		t.Fatal(err)
+	}
+	if letter.Publisher != "bmj" || letter.Key != "files/bmj/1.zip" || letter.Attempts != 3 || letter.Body != "{}" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+	if len(letter.Errors) != 3 || letter.Errors[2] != "attempt 3: broken archive" {
+		t.Errorf("unexpected errors %v", letter.Errors)
+	}
+
+	if errs := s.record(&services.Message{ID: "1"}, "next"); len(errs) != 1 {
+		t.Errorf("errors of a dead lettered message kept: %v", errs)
+	}
+}
+
+func TestSuccessForgets(t *testing.T) {
+
+	queue := &publishers.MockQueue{}
+	s := New(queue, "new", "dead", Policy{}, openDB(t))
+
+	job := newJob(t, "files/bmj/1.zip")
+	m := &services.Message{ID: "1", Receipt: "receipt", Attempts: 1}
+
+	s.Run(context.Background(), &failing{err: errors.New("timeout")}, job, m)
+	m.Attempts = 2
+	if result := s.Run(context.Background(), &failing{}, job, m); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	if errs := s.record(m, "again"); len(errs) != 1 {
+		t.Errorf("errors of a succeeded message kept: %v", errs)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+
+	queue := &publishers.MockQueue{}
+
+	heartbeat := Beat(queue, "new", "receipt", 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	heartbeat.Stop()
+
+	if got := queue.Visibility["receipt"]; got != 20*time.Millisecond {
+		t.Errorf("expected visibility 20ms got %v", got)
+	}
+
+	delete(queue.Visibility, "receipt")
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := queue.Visibility["receipt"]; ok {
+		t.Error("visibility extended after Stop")
+	}
+}
+
+func TestRunHeartbeat(t *testing.T) {
+
+	queue := &publishers.MockQueue{}
+	s := New(queue, "new", "", Policy{Visibility: time.Hour, Backoff: time.Minute}, nil)
+
+	m := &services.Message{ID: "1", Receipt: "receipt", Attempts: 1}
+	s.Run(context.Background(), &failing{}, newJob(t, "files/bmj/1.zip"), m)
+	if got := queue.Visibility["receipt"]; got != time.Hour {
+		t.Errorf("expected visibility 1h while running got %v", got)
+	}
+
+	// the backoff of a failure isn't overwritten by the heartbeat
+	s.Run(context.Background(), &failing{err: errors.New("timeout")}, newJob(t, "files/bmj/1.zip"), m)
+	if got := queue.Visibility["receipt"]; got != time.Minute {
+		t.Errorf("expected backoff 1m got %v", got)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+
+	queue := &publishers.MockQueue{}
+	s := New(queue, "new", "dead", Policy{MaxAttempts: 1}, openDB(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	m := &services.Message{ID: "1", Receipt: "receipt", Attempts: 1}
+	s.Run(ctx, &failing{err: context.Canceled}, newJob(t, "files/bmj/1.zip"), m)
+
+	if len(queue.Messages) != 0 || len(queue.Popped) != 0 {
+		t.Errorf("cancelled job dead lettered: %v", queue.Messages)
+	}
+	if got, ok := queue.Visibility["receipt"]; !ok || got != 0 {
+		t.Errorf("expected the message visible again, got %v", got)
+	}
+}
@@ -0,0 +1,145 @@
+package publishers
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/yewno/acquisition/config"
+	"github.com/yewno/acquisition/services"
+)
+
+// spoolMemory is how much of an entry Spool keeps in memory, larger
+// entries are written to a temporary file.
+const spoolMemory = 5 * 1024 * 1024
+
+// Concurrency is how many entries of an archive the publisher uploads at a
+// time. The -publisher-concurrency flag wins over what the publisher asks
+// for itself, which wins over -upload-concurrency.
+func Concurrency(cfg *config.Config, publisher string, own int) int {
+	if n := cfg.PublisherConcurrency[publisher]; n > 0 {
+		return n
+	}
+	if own > 0 {
+		return own
+	}
+	if cfg.UploadConcurrency > 0 {
+		return cfg.UploadConcurrency
+	}
+	return 1
+}
+
+// Compression is how the publisher's objects are compressed. The
+// -publisher-compression flag wins over what the publisher asks for
+// itself, which wins over -compression.
+func Compression(cfg *config.Config, publisher string, own map[string]string) services.Compression {
+	if c, ok := cfg.PublisherCompression[publisher]; ok {
+		return c
+	}
+	if own != nil {
+		return own
+	}
+	return cfg.Compression
+}
+
+// Tags are the object tags of an entry of the archive.
+func Tags(publisher, archive string, class Class) map[string]string {
+	return map[string]string{
+		services.TagPublisher: publisher,
+		services.TagArchive:   archive,
+		services.TagClass:     class.String(),
+	}
+}
+
+// Uploads runs the uploads of an archive's entries, at most limit at a
+// time. Archives are read one entry at a time, so with a limit above one
+// the body of an entry is spooled off the archive before it is uploaded.
+type Uploads struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+func NewUploads(limit int) *Uploads {
+	if limit < 1 {
+		limit = 1
+	}
+	return &Uploads{sem: make(chan struct{}, limit)}
+}
+
+// Go calls upload with body once a slot is free. With a limit of one the
+// upload is done before Go returns, otherwise it runs in the background
+// and Wait waits for it.
+func (u *Uploads) Go(body io.Reader, upload func(io.Reader)) error {
+
+	if cap(u.sem) == 1 {
+		upload(body)
+		return nil
+	}
+
+	u.sem <- struct{}{}
+	spooled, err := Spool(body)
+	if err != nil {
+		<-u.sem
+		return err
+	}
+
+	u.wg.Add(1)
+	go func() {
+		defer func() {
+			spooled.Close()
+			<-u.sem
+			u.wg.Done()
+		}()
+		upload(spooled)
+	}()
+	return nil
+}
+
+// Wait waits for the uploads started by Go.
+func (u *Uploads) Wait() {
+	u.wg.Wait()
+}
+
+// Spool reads r to the end, in memory when it is small and into a
+// temporary file otherwise. Closing the spool removes the file. The file
+// is seekable, so SaveStream reads it in place.
+func Spool(r io.Reader) (io.ReadCloser, error) {
+
+	head, more, err := services.ReadHead(r, spoolMemory)
+	if err != nil {
+		return nil, err
+	}
+	if !more {
+		return ioutil.NopCloser(bytes.NewReader(head)), nil
+	}
+
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spoolFile{file}
+
+	if _, err := io.Copy(file, io.MultiReader(bytes.NewReader(head), r)); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+type spoolFile struct {
+	*os.File
+}
+
+func (s *spoolFile) Close() error {
+	if err := s.File.Close(); err != nil {
+		log.Println(err)
+	}
+	return os.Remove(s.File.Name())
+}
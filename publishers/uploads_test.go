@@ -0,0 +1,121 @@
+package publishers
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yewno/acquisition/config"
+)
+
+func TestUploads(t *testing.T) {
+
+	var (
+		mu       sync.Mutex
+		running  int
+		most     int
+		uploaded = make([]string, 10)
+	)
+
+	uploads := NewUploads(3)
+	for i := range uploaded {
+		i := i
+		err := uploads.Go(bytes.NewReader([]byte{byte('a' + i)}), func(body io.Reader) {
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+			b, _ := ioutil.ReadAll(body)
+			uploaded[i] = string(b)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	uploads.Wait()
+
+	if most > 3 || most < 2 {
+		t.Errorf("expected up to 3 uploads at a time, got %d", most)
+	}
+	for i, body := range uploaded {
+		if body != string(rune('a'+i)) {
+			t.Errorf("upload %d got %q", i, body)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+
+	large := bytes.Repeat([]byte("a"), spoolMemory+1)
+	spooled, err := Spool(bytes.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, ok := spooled.(*spoolFile)
+	if !ok {
+		t.Fatal("expected a large entry spooled to a file")
+	}
+
+	b, err := ioutil.ReadAll(spooled)
+	if err != nil || !bytes.Equal(b, large) {
+		t.Errorf("spooled %d bytes, %v", len(b), err)
+	}
+	spooled.Close()
+	if _, err := os.Stat(file.Name()); !os.IsNotExist(err) {
+		t.Error("spool file left behind")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+
+	cfg := &config.Config{UploadConcurrency: 4, PublisherConcurrency: map[string]int{"pnas": 8}}
+
+	expected := []struct {
+		publisher string
+		own       int
+		n         int
+	}{
+		{"bmj", 0, 4},
+		{"bmj", 2, 2},
+		{"pnas", 2, 8},
+	}
+	for _, e := range expected {
+		if n := Concurrency(cfg, e.publisher, e.own); n != e.n {
+			t.Errorf("%s %d: expected %d got %d", e.publisher, e.own, e.n, n)
+		}
+	}
+	if n := Concurrency(&config.Config{}, "bmj", 0); n != 1 {
+		t.Errorf("expected 1 without configuration, got %d", n)
+	}
+}
+
+func TestCompression(t *testing.T) {
+
+	cfg := &config.Config{
+		Compression:          map[string]string{".xml": "gzip"},
+		PublisherCompression: map[string]map[string]string{"pnas": {".xml": "zstd"}},
+	}
+	own := map[string]string{".xml": "none"}
+
+	if c := Compression(cfg, "bmj", nil); c.Codec("a.xml") != "gzip" {
+		t.Errorf("expected -compression, got %v", c)
+	}
+	if c := Compression(cfg, "bmj", own); c.Codec("a.xml") != "none" {
+		t.Errorf("expected the publisher's own, got %v", c)
+	}
+	if c := Compression(cfg, "pnas", own); c.Codec("a.xml") != "zstd" {
+		t.Errorf("expected -publisher-compression, got %v", c)
+	}
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs objects are compressed with before they are stored.
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// codecExt is appended to the key of an object stored compressed.
+var codecExt = map[string]string{
+	CodecGzip: ".gz",
+	CodecZstd: ".zst",
+}
+
+// Compression maps file extensions to the codec objects with the
+// extension are stored with, extensions it leaves out aren't compressed.
+type Compression map[string]string
+
+// DefaultCompression gzips xml, what acquisition has always done.
+var DefaultCompression = Compression{".xml": CodecGzip}
+
+// ParseCompression reads a list of extension=codec pairs, as in
+// .xml=gzip,.json=zstd.
+func ParseCompression(s string) (Compression, error) {
+
+	c := make(Compression)
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("compression: %q isn't extension=codec", pair)
+		}
+		c[parts[0]] = parts[1]
+	}
+	return c, c.Validate()
+}
+
+// Validate fails on codecs it doesn't know.
+func (c Compression) Validate() error {
+	for ext, codec := range c {
+		if _, ok := codecExt[codec]; !ok && codec != CodecNone {
+			return fmt.Errorf("compression: unknown codec %q for %s", codec, ext)
+		}
+	}
+	return nil
+}
+
+// Codec is the codec for key, CodecNone when it isn't compressed.
+func (c Compression) Codec(key string) string {
+	if c == nil {
+		c = DefaultCompression
+	}
+	if codec, ok := c[path.Ext(key)]; ok {
+		return codec
+	}
+	return CodecNone
+}
+
+// compressor writes what is written to it compressed with the codec to w.
+func compressor(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("compression: unknown codec %q", codec)
+}
+
+// compressReader compresses r with the codec as it is read. Closing it
+// stops the compression of what is left.
+func compressReader(codec string, r io.Reader) io.ReadCloser {
+
+	reader, writer := io.Pipe()
+	go func() {
+		compressed, err := compressor(codec, writer)
+		if err == nil {
+			_, err = io.Copy(compressed, r)
+			if cerr := compressed.Close(); err == nil {
+				err = cerr
+			}
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+// contentType is the type of an object with the key from its extension,
+// or sniffed from the head of its content when the extension is unknown.
+func contentType(key string, head []byte) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return http.DetectContentType(head)
+}
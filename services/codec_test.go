@@ -0,0 +1,101 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompression(t *testing.T) {
+
+	c, err := ParseCompression(".xml=zstd,.pdf=none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"a.xml": CodecZstd, "a.pdf": CodecNone, "a.jpg": CodecNone}
+	for key, codec := range expected {
+		if got := c.Codec(key); got != codec {
+			t.Errorf("%s: expected %s got %s", key, codec, got)
+		}
+	}
+	if got := Compression(nil).Codec("a.xml"); got != CodecGzip {
+		t.Errorf("expected xml gzipped by default, got %s", got)
+	}
+	if _, err := ParseCompression(".xml=lz4"); err == nil {
+		t.Error("expected an unknown codec to fail")
+	}
+}
+
+func TestSaveZstd(t *testing.T) {
+
+	storage := newMemStorage()
+	compression := Compression{".xml": CodecZstd}
+
+	for _, size := range []int{100, 3 * streamBuffer / 2} {
+
+		content := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(content)
+
+		object := NewObject(nil, "processed", "a.xml", 0)
+		object.Compression = compression
+		if err := object.SaveStream(context.Background(), storage, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		if object.Key != "a.xml.zst" {
+			t.Fatalf("%d bytes: unexpected key %s", size, object.Key)
+		}
+
+		headers := storage.headers["processed/a.xml.zst"]
+		if headers[0] == "" || headers[1] != CodecZstd {
+			t.Errorf("%d bytes: unexpected headers %v", size, headers)
+		}
+		if got := storage.metadata["processed/a.xml.zst"][MetaOriginalSize]; got != strconv.Itoa(size) {
+			t.Errorf("%d bytes: original size %q", size, got)
+		}
+
+		reader, err := zstd.NewReader(bytes.NewReader(storage.objects["processed/a.xml.zst"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(stored, content) {
+			t.Errorf("%d bytes: stored content differs", size)
+		}
+	}
+}
+
+func TestSaveContentType(t *testing.T) {
+
+	storage := newMemStorage()
+
+	for key, expected := range map[string]string{
+		"a.pdf":     "application/pdf",
+		"a.unknown": "text/plain; charset=utf-8",
+	} {
+		file, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString("plain text")
+		defer os.Remove(file.Name())
+
+		object := NewObject(file, "processed", key, 0)
+		if err := object.Save(context.Background(), storage); err != nil {
+			t.Fatal(err)
+		}
+		headers := storage.headers["processed/"+key]
+		if headers[0] != expected || headers[1] != "" {
+			t.Errorf("%s: unexpected headers %v", key, headers)
+		}
+		if got := storage.metadata["processed/"+key][MetaOriginalSize]; got != "10" {
+			t.Errorf("%s: original size %q", key, got)
+		}
+	}
+}
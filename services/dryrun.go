@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Recorder keeps what a dry run would have written to storage and sent to
+// queues, one JSON line per action, in a file.
+type Recorder struct {
+	mu       sync.Mutex
+	filename string
+}
+
+// NewRecorder records to filename, truncating what an earlier dry run
+// left there.
+func NewRecorder(filename string) (*Recorder, error) {
+	if err := ioutil.WriteFile(filename, nil, 0666); err != nil {
+		return nil, err
+	}
+	return &Recorder{filename: filename}, nil
+}
+
+// Action is a line of the record of a dry run.
+type Action struct {
+	// Op is put, upload or set-metadata for storage and send or delete
+	// for queues.
+	Op     string `json:"op"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+
+	Queue   string          `json:"queue,omitempty"`
+	Receipt string          `json:"receipt,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+}
+
+func (r *Recorder) record(actions ...*Action) error {
+
+	lines := make([]string, 0, len(actions))
+	for _, a := range actions {
+		b, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, string(b))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return appendLines(r.filename, lines)
+}
+
+func (r *Recorder) object(op string, o *Object, size int64) error {
+	return r.record(&Action{
+		Op:              op,
+		Bucket:          o.Bucket,
+		Key:             o.Key,
+		Size:            size,
+		ContentType:     o.ContentType,
+		ContentEncoding: o.ContentEncoding,
+		Metadata:        o.Metadata,
+		Tags:            o.Tags,
+	})
+}
+
+// DryRunStorage reads from the storage it wraps and records writes instead
+// of doing them.
+type DryRunStorage struct {
+	CobaltStorage
+	Recorder *Recorder
+}
+
+func (s *DryRunStorage) Put(ctx context.Context, o *Object) error {
+	return s.Recorder.object("put", o, o.Size)
+}
+
+// Upload reads body to the end, streamed objects are hashed as they are
+// read.
+func (s *DryRunStorage) Upload(ctx context.Context, o *Object, body io.Reader) error {
+	size, err := io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return err
+	}
+	return s.Recorder.object("upload", o, size)
+}
+
+func (s *DryRunStorage) SetMetadata(ctx context.Context, o *Object) error {
+	return s.Recorder.object("set-metadata", o, 0)
+}
+
+// DryRunQueue receives from the queue it wraps but records sends and
+// deletes instead of doing them, and leaves the visibility of messages
+// alone.
+type DryRunQueue struct {
+	CobaltQueue
+	Recorder *Recorder
+}
+
+func (q *DryRunQueue) Pop(ctx context.Context, queue, receipt string) error {
+	return q.Recorder.record(&Action{Op: "delete", Queue: queue, Receipt: receipt})
+}
+
+func (q *DryRunQueue) ExtendVisibility(ctx context.Context, queue, receipt string, timeout time.Duration) error {
+	return nil
+}
+
+func (q *DryRunQueue) NewBatch(ctx context.Context, queue string) CobaltQueueBatch {
+	return &dryRunBatch{recorder: q.Recorder, queue: queue}
+}
+
+type dryRunBatch struct {
+	recorder *Recorder
+	queue    string
+	actions  []*Action
+}
+
+func (b *dryRunBatch) Add(m interface{}) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	b.actions = append(b.actions, &Action{Op: "send", Queue: b.queue, Body: body})
+	return nil
+}
+
+func (b *dryRunBatch) Flush() error {
+	if len(b.actions) == 0 {
+		return nil
+	}
+	if err := b.recorder.record(b.actions...); err != nil {
+		return err
+	}
+	b.actions = nil
+	return nil
+}
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	files := NewFileStorage(filepath.Join(dir, "root"))
+
+	recorder, err := NewRecorder(filepath.Join(dir, "dry-run.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &DryRunStorage{CobaltStorage: files, Recorder: recorder}
+	queue := &DryRunQueue{Recorder: recorder}
+
+	small := NewObject(nil, "processed", "bmj/1.xml", 0)
+	if err := small.SaveStream(ctx, storage, strings.NewReader("<article/>")); err != nil {
+		t.Fatal(err)
+	}
+	large := NewObject(nil, "processed", "bmj/1.pdf", 0)
+	if err := large.SaveStream(ctx, storage, bytes.NewReader(make([]byte, streamBuffer+1))); err != nil {
+		t.Fatal(err)
+	}
+	if large.Hash == "" || large.Size != streamBuffer+1 {
+		t.Errorf("expected the large object to be hashed, got %q of %d bytes", large.Hash, large.Size)
+	}
+
+	batch := queue.NewBatch(ctx, "processed")
+	batch.Add(&PairMessage{Source: "bmj", Key: small.Key, MetaKey: large.Key})
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Pop(ctx, "new", "receipt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if objects, err := files.List(ctx, "processed", ""); err != nil || len(objects) != 0 {
+		t.Errorf("expected nothing stored, got %v %v", objects, err)
+	}
+
+	b, err := ioutil.ReadFile(recorder.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		a := &Action{}
+		if err := json.Unmarshal([]byte(line), a); err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, a.Op+" "+a.Key+a.Queue)
+	}
+	expected := []string{"upload bmj/1.xml.gz", "upload bmj/1.pdf", "send processed", "delete new"}
+	if strings.Join(ops, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, ops)
+	}
+}
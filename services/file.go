@@ -0,0 +1,321 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/yewno/acquisition/config"
+)
+
+// metaDir is the directory at the top of every bucket holding the
+// metadata sidecars of its objects.
+const metaDir = ".meta"
+
+// FileStorage keeps objects in a directory tree, bucket/key under Root.
+// Writes are atomic, an object is written next to where it goes and
+// renamed into place. What S3 keeps with an object is kept in a JSON
+// sidecar under the .meta directory of the bucket.
+//
+// The zero value is rooted at the working directory, buckets can be
+// absolute paths.
+type FileStorage struct {
+	Root string
+}
+
+func NewFileStorage(root string) *FileStorage {
+	return &FileStorage{Root: root}
+}
+
+// NewStorage opens the storage cfg.Storage names, S3 when it is empty.
+func NewStorage(cfg *config.Config) (CobaltStorage, error) {
+
+	if cfg.Storage == "" || cfg.Storage == "s3" {
+		return NewCobaltS3(cfg)
+	}
+
+	u, err := url.Parse(cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" || u.Path == "" {
+		return nil, fmt.Errorf("storage: %q is neither s3 nor a file:// URL", cfg.Storage)
+	}
+	if err := os.MkdirAll(u.Path, 0777); err != nil {
+		return nil, err
+	}
+	return NewFileStorage(u.Path), nil
+}
+
+// sidecar is what is stored about an object besides its content.
+type sidecar struct {
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+}
+
+// filename is where the object is stored, keys can't leave their bucket.
+func (f *FileStorage) filename(o *Object) (string, error) {
+	key := path.Clean("/" + o.Key)[1:]
+	if key == "" || key == metaDir || strings.HasPrefix(key, metaDir+"/") {
+		return "", fmt.Errorf("file storage: invalid key %q", o.Key)
+	}
+	return filepath.Join(f.Root, o.Bucket, filepath.FromSlash(key)), nil
+}
+
+func (f *FileStorage) sidecarFilename(o *Object) string {
+	key := path.Clean("/" + o.Key)[1:]
+	return filepath.Join(f.Root, o.Bucket, metaDir, filepath.FromSlash(key)+".json")
+}
+
+// Get copies the object to a temporary file, like CobaltS3 does, so
+// closing the object leaves the stored one alone.
+func (f *FileStorage) Get(ctx context.Context, o *Object) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	filename, err := f.filename(o)
+	if err != nil {
+		return err
+	}
+	stored, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	defer stored.Close()
+
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(file, stored)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	o.File = file
+	o.Size = size
+
+	_, err = o.File.Seek(0, 0)
+	return err
+}
+
+func (f *FileStorage) GetRange(ctx context.Context, o *Object, offset, length int64) (io.ReadCloser, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	filename, err := f.filename(o)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, offset, length), file}, nil
+}
+
+func (f *FileStorage) Put(ctx context.Context, o *Object) error {
+	return f.Upload(ctx, o, o.File)
+}
+
+func (f *FileStorage) Upload(ctx context.Context, o *Object, body io.Reader) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	filename, err := f.filename(o)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filename, body); err != nil {
+		return err
+	}
+	return f.SetMetadata(ctx, o)
+}
+
+func (f *FileStorage) SetMetadata(ctx context.Context, o *Object) error {
+
+	filename, err := f.filename(o)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return ErrNotExist
+	}
+
+	b, err := json.Marshal(&sidecar{
+		Metadata:        o.Metadata,
+		ContentType:     o.ContentType,
+		ContentEncoding: o.ContentEncoding,
+		Tags:            o.Tags,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFile(f.sidecarFilename(o), bytes.NewReader(b))
+}
+
+func (f *FileStorage) Head(ctx context.Context, o *Object) error {
+
+	filename, err := f.filename(o)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	o.Size = stat.Size()
+	o.Modified = stat.ModTime()
+	if o.ETag, err = etag(filename); err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(f.sidecarFilename(o))
+	if os.IsNotExist(err) {
+		// copied in by hand, it has no metadata
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s := &sidecar{}
+	if err := json.Unmarshal(b, s); err != nil {
+		log.Println(err)
+		return nil
+	}
+	o.Metadata = s.Metadata
+	o.ContentType = s.ContentType
+	o.ContentEncoding = s.ContentEncoding
+	o.Tags = s.Tags
+	return nil
+}
+
+// etag is the hex MD5 of the file, the ETag S3 gives objects uploaded in
+// one part.
+func etag(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (f *FileStorage) List(ctx context.Context, bucket, prefix string) ([]*Object, error) {
+
+	root := filepath.Join(f.Root, bucket)
+	objects := make([]*Object, 0, 100)
+
+	err := filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filename == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			if key == metaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// temporary files of writes in progress
+		if strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+		if strings.HasPrefix(key, prefix) {
+			object := NewObject(nil, bucket, key, info.Size())
+			object.Modified = info.ModTime()
+			objects = append(objects, object)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// writeFile writes what is read from r to a temporary file next to
+// filename and renames it into place once it is complete.
+func writeFile(filename string, r io.Reader) error {
+
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(temp, r)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yewno/acquisition/config"
+)
+
+func TestFileStorage(t *testing.T) {
+
+	ctx := context.Background()
+	storage, err := NewStorage(&config.Config{Storage: "file://" + t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := storage.(*FileStorage)
+
+	object := NewObject(nil, "processed", "bmj/1.xml", 0)
+	object.Metadata = map[string]string{MetaSHA256: "abc"}
+	object.ContentType = "text/xml"
+	if err := files.Upload(ctx, object, strings.NewReader("a longer first version")); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Upload(ctx, object, strings.NewReader("shorter")); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := NewObject(nil, "processed", "bmj/1.xml", 0)
+	if err := files.Get(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(stored.File)
+	stored.Close()
+	if string(b) != "shorter" {
+		t.Errorf("unexpected content %q", b)
+	}
+
+	head := NewObject(nil, "processed", "bmj/1.xml", 0)
+	if err := files.Head(ctx, head); err != nil {
+		t.Fatal(err)
+	}
+	if head.Size != 7 || head.Metadata[MetaSHA256] != "abc" || head.ContentType != "text/xml" || head.ETag != fmt.Sprintf("%x", md5.Sum([]byte("shorter"))) {
+		t.Errorf("unexpected head %+v", head)
+	}
+
+	for _, key := range []string{"bmj/2.pdf", "oup/1.pdf"} {
+		if err := files.Upload(ctx, NewObject(nil, "processed", key, 0), strings.NewReader("pdf")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, err := files.List(ctx, "processed", "bmj/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "bmj/1.xml" || objects[1].Key != "bmj/2.pdf" {
+		t.Errorf("unexpected listing %v", objects)
+	}
+	if objects, _ := files.List(ctx, "missing", ""); len(objects) != 0 {
+		t.Errorf("unexpected listing of a missing bucket %v", objects)
+	}
+
+	if err := files.Head(ctx, NewObject(nil, "processed", "bmj/3.pdf", 0)); err != ErrNotExist {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	if err := files.Upload(ctx, NewObject(nil, "processed", ".meta/x", 0), strings.NewReader("x")); err == nil {
+		t.Error("expected a key in the sidecar directory to fail")
+	}
+
+	// keys can't climb out of their bucket
+	if err := files.Upload(ctx, NewObject(nil, "processed", "../ftp/1.pdf", 0), strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(files.Root, "processed", "ftp/1.pdf")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yewno/acquisition/config"
+)
+
+// ackSuffix is appended to the name of an events file for the sidecar
+// recording what happened to its events.
+const ackSuffix = ".acks"
+
+// FileQueue replays S3 events recorded one per line in JSONL files, in
+// place of the new content queue, and appends what is sent to any queue
+// to an output JSONL file. Lines can be the events themselves, as SQS
+// delivers them, or SNS notifications wrapping them.
+//
+// Receiving and deleting an event is recorded in a sidecar next to its
+// file, so a replay only hands out the events earlier replays didn't
+// delete, and counts the attempts of those they did hand out.
+type FileQueue struct {
+	mu       sync.Mutex
+	messages []*Message
+	output   string
+}
+
+// NewQueue opens the queue cfg.Queue names, SQS when it is empty.
+func NewQueue(cfg *config.Config, queues ...string) (CobaltQueue, error) {
+
+	if cfg.Queue == "" || cfg.Queue == "sqs" {
+		return NewCobaltSqs(cfg, queues...)
+	}
+
+	u, err := url.Parse(cfg.Queue)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" || u.Path == "" {
+		return nil, fmt.Errorf("queue: %q is neither sqs nor a file:// URL", cfg.Queue)
+	}
+	return NewFileQueue(u.Path, cfg.QueueOutput)
+}
+
+// NewFileQueue reads the events of a JSONL file, or of every *.jsonl file
+// of a directory, and sends to output.
+func NewFileQueue(events, output string) (*FileQueue, error) {
+
+	filenames := []string{events}
+	stat, err := os.Stat(events)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		if filenames, err = filepath.Glob(filepath.Join(events, "*.jsonl")); err != nil {
+			return nil, err
+		}
+		sort.Strings(filenames)
+	}
+
+	q := &FileQueue{output: output}
+	for _, filename := range filenames {
+		if abs(filename) == abs(output) {
+			continue
+		}
+		if err := q.read(filename); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func abs(filename string) string {
+	a, err := filepath.Abs(filename)
+	if err != nil {
+		return filename
+	}
+	return a
+}
+
+// read adds the events of the file that weren't deleted yet.
+func (q *FileQueue) read(filename string) error {
+
+	received, deleted, err := readAcks(filename + ackSuffix)
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		// the receipt is the ID, it names the file for Pop
+		id := fmt.Sprintf("%s:%d", filename, i+1)
+		if deleted[id] {
+			continue
+		}
+		q.messages = append(q.messages, &Message{
+			QueueUrl: filename,
+			Receipt:  id,
+			ID:       id,
+			Body:     unwrap(line),
+			Attempts: received[id] + 1,
+		})
+	}
+	return nil
+}
+
+// unwrap returns the message of an SNS notification, other lines as they
+// are.
+func unwrap(line string) string {
+	notification := struct {
+		Type    string
+		Message string
+	}{}
+	if err := json.Unmarshal([]byte(line), &notification); err != nil || notification.Type != "Notification" {
+		return line
+	}
+	return notification.Message
+}
+
+// ack is a line of the sidecar of an events file.
+type ack struct {
+	ID      string    `json:"id"`
+	Deleted bool      `json:"deleted,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func readAcks(filename string) (map[string]int, map[string]bool, error) {
+
+	received := make(map[string]int)
+	deleted := make(map[string]bool)
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return received, deleted, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		a := &ack{}
+		if err := json.Unmarshal(scanner.Bytes(), a); err != nil {
+			log.Println(filename, err)
+			continue
+		}
+		if a.Deleted {
+			deleted[a.ID] = true
+		} else {
+			received[a.ID]++
+		}
+	}
+	return received, deleted, scanner.Err()
+}
+
+// record appends to the sidecar of the event's file.
+func (q *FileQueue) record(receipt string, deleted bool) error {
+
+	filename := receipt[:strings.LastIndex(receipt, ":")]
+	if _, err := strconv.Atoi(receipt[len(filename)+1:]); err != nil {
+		return fmt.Errorf("queue: unknown receipt %q", receipt)
+	}
+
+	b, err := json.Marshal(&ack{ID: receipt, Deleted: deleted, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return appendLines(filename+ackSuffix, []string{string(b)})
+}
+
+// Poll hands out every event once, whatever the queue, then nil once they
+// are all handed out, like SQS does for an empty queue, and closes the
+// channel.
+func (q *FileQueue) Poll(ctx context.Context, queue string, max int) chan *Message {
+	response := make(chan *Message, max)
+
+	go func(channel chan *Message) {
+		defer close(channel)
+
+		q.mu.Lock()
+		messages := q.messages
+		q.messages = nil
+		q.mu.Unlock()
+
+		for _, m := range append(messages, nil) {
+			if m != nil {
+				if err := q.record(m.Receipt, false); err != nil {
+					log.Println(err)
+				}
+			}
+			select {
+			case channel <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(response)
+
+	return response
+}
+
+func (q *FileQueue) Pop(ctx context.Context, queue, receipt string) error {
+	return q.record(receipt, true)
+}
+
+// ExtendVisibility does nothing, an event isn't handed out again until
+// the next replay.
+func (q *FileQueue) ExtendVisibility(ctx context.Context, queue, receipt string, timeout time.Duration) error {
+	return nil
+}
+
+func (q *FileQueue) NewBatch(ctx context.Context, queue string) CobaltQueueBatch {
+	return &FileQueueBatch{queue: q, name: queue}
+}
+
+// Sent is a line of the output of a FileQueue.
+type Sent struct {
+	Queue string          `json:"queue"`
+	Body  json.RawMessage `json:"body"`
+}
+
+// FileQueueBatch appends its messages to the output of the queue when it
+// is flushed.
+type FileQueueBatch struct {
+	queue *FileQueue
+	name  string
+	lines []string
+}
+
+func (b *FileQueueBatch) Add(m interface{}) error {
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(&Sent{Queue: b.name, Body: body})
+	if err != nil {
+		return err
+	}
+	b.lines = append(b.lines, string(line))
+	return nil
+}
+
+func (b *FileQueueBatch) Flush() error {
+
+	if len(b.lines) == 0 {
+		return nil
+	}
+
+	b.queue.mu.Lock()
+	defer b.queue.mu.Unlock()
+	if err := appendLines(b.queue.output, b.lines); err != nil {
+		return err
+	}
+	b.lines = nil
+	return nil
+}
+
+func appendLines(filename string, lines []string) error {
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(strings.Join(lines, "\n") + "\n")
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
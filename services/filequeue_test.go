@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func poll(t *testing.T, q *FileQueue) []*Message {
+	messages := make([]*Message, 0)
+	for m := range q.Poll(context.Background(), "new", 1) {
+		if m == nil {
+			break
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+func TestFileQueue(t *testing.T) {
+
+	dir := t.TempDir()
+	events := filepath.Join(dir, "events.jsonl")
+	output := filepath.Join(dir, "sent.jsonl")
+
+	event := `{"Records": [{"s3": {"bucket": {"name": "ftp"}, "object": {"key": "files/bmj/1.zip", "size": 1}}}]}`
+	notification, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": event})
+	if err := ioutil.WriteFile(events, []byte(event+"\n\n"+string(notification)+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewFileQueue(dir, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := poll(t, q)
+	if len(messages) != 2 || messages[0].Body != event || messages[1].Body != event {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+	if messages[0].Attempts != 1 {
+		t.Errorf("expected a first attempt, got %d", messages[0].Attempts)
+	}
+
+	if err := q.Pop(context.Background(), "new", messages[0].Receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := q.NewBatch(context.Background(), "processed")
+	batch.Add(&PairMessage{Source: "bmj", Key: "bmj/1.pdf", MetaKey: "bmj/1.xml.gz"})
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := &Sent{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(string(b))), sent); err != nil {
+		t.Fatal(err)
+	}
+	m := &PairMessage{}
+	if err := json.Unmarshal(sent.Body, m); err != nil || sent.Queue != "processed" || m.Key != "bmj/1.pdf" {
+		t.Errorf("unexpected output %s", b)
+	}
+
+	// a replay hands out what wasn't deleted, once more
+	q, err = NewFileQueue(events, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages = poll(t, q)
+	if len(messages) != 1 || messages[0].ID != events+":3" || messages[0].Attempts != 2 {
+		t.Errorf("unexpected replay %+v", messages)
+	}
+}
@@ -1,17 +1,50 @@
 package services
 
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotExist is returned by Head for objects that aren't in storage.
+var ErrNotExist = errors.New("services: object does not exist")
+
+// CobaltQueue is a message queue. Poll stops and closes its channel when
+// the context is done.
 type CobaltQueue interface {
-	Poll(string, int) chan *Message
-	Pop(string, string) error
-	NewBatch(string) CobaltQueueBatch
+	Poll(context.Context, string, int) chan *Message
+	Pop(context.Context, string, string) error
+	// ExtendVisibility keeps a received message hidden from other
+	// consumers for the duration, counted from now.
+	ExtendVisibility(ctx context.Context, queue, receipt string, timeout time.Duration) error
+	// NewBatch returns a batch whose messages are sent under the context.
+	NewBatch(context.Context, string) CobaltQueueBatch
 }
 
 type CobaltQueueBatch interface {
 	Add(interface{}) error
-	Flush()
+	// Flush sends what is left of the batch and fails if any message of
+	// the batch couldn't be sent.
+	Flush() error
 }
 
 type CobaltStorage interface {
-	Get(*Object) error
-	Put(*Object) error
+	Get(context.Context, *Object) error
+	// GetRange reads length bytes of an object from offset on.
+	GetRange(ctx context.Context, object *Object, offset, length int64) (io.ReadCloser, error)
+	Put(context.Context, *Object) error
+	// Head fills in the size and metadata of an object without
+	// downloading it.
+	Head(context.Context, *Object) error
+	// Upload stores what is read from body under the object's key, in
+	// parts as it is read when it is large.
+	Upload(ctx context.Context, object *Object, body io.Reader) error
+	// SetMetadata replaces the metadata of a stored object with the
+	// object's Metadata.
+	SetMetadata(context.Context, *Object) error
+	// List returns the objects of the bucket whose keys start with
+	// prefix, in the order of their keys, with their size and time of
+	// last modification.
+	List(ctx context.Context, bucket, prefix string) ([]*Object, error)
 }
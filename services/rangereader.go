@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Reads from a RangeReader are rounded up to blocks of rangeBlock bytes and
+// the last rangeBlocks blocks are kept, so the many small reads of a zip
+// directory and of entries read front to back cost one request per block.
+const (
+	rangeBlock  = 1024 * 1024
+	rangeBlocks = 8
+)
+
+// RangeReader reads an object in storage at any offset with ranged gets,
+// without downloading all of it.
+type RangeReader struct {
+	ctx    context.Context
+	conn   CobaltStorage
+	object *Object
+
+	mu     sync.Mutex
+	blocks map[int64][]byte
+	// recent are the cached blocks, least recently used first.
+	recent []int64
+}
+
+// NewRangeReader returns a reader over the object, whose Size must be set.
+func NewRangeReader(ctx context.Context, conn CobaltStorage, object *Object) *RangeReader {
+	return &RangeReader{
+		ctx:    ctx,
+		conn:   conn,
+		object: object,
+		blocks: make(map[int64][]byte, rangeBlocks),
+		recent: make([]int64, 0, rangeBlocks),
+	}
+}
+
+// Size is the size of the object.
+func (r *RangeReader) Size() int64 {
+	return r.object.Size
+}
+
+func (r *RangeReader) ReadAt(p []byte, off int64) (int, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off >= r.object.Size {
+			return n, io.EOF
+		}
+
+		index := off / rangeBlock
+		block, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+
+		copied := copy(p[n:], block[off-index*rangeBlock:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// block returns the block at index from the cache or storage.
+func (r *RangeReader) block(index int64) ([]byte, error) {
+
+	if block, ok := r.blocks[index]; ok {
+		r.use(index)
+		return block, nil
+	}
+
+	offset := index * rangeBlock
+	length := int64(rangeBlock)
+	if offset+length > r.object.Size {
+		length = r.object.Size - offset
+	}
+
+	body, err := r.conn.GetRange(r.ctx, r.object, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	block, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(block)) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if len(r.recent) == rangeBlocks {
+		delete(r.blocks, r.recent[0])
+		r.recent = r.recent[1:]
+	}
+	r.blocks[index] = block
+	r.recent = append(r.recent, index)
+	return block, nil
+}
+
+// use moves a cached block to the end of recent.
+func (r *RangeReader) use(index int64) {
+	for i, cached := range r.recent {
+		if cached == index {
+			r.recent = append(append(r.recent[:i:i], r.recent[i+1:]...), index)
+			return
+		}
+	}
+}
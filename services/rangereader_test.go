@@ -0,0 +1,45 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestRangeReader(t *testing.T) {
+
+	content := make([]byte, 3*rangeBlock+rangeBlock/2)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	storage := newMemStorage()
+	storage.objects["ftp/a.zip"] = content
+
+	reader := NewRangeReader(context.Background(), storage, NewObject(nil, "ftp", "a.zip", int64(len(content))))
+
+	// front to back in small reads, a request per block
+	p := make([]byte, 1000)
+	for off := int64(0); off < int64(len(content)); off += int64(len(p)) {
+		n, err := reader.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p[:n], content[off:off+int64(n)]) {
+			t.Fatalf("read at %d differs", off)
+		}
+	}
+	if storage.ranges != 4 {
+		t.Errorf("expected 4 ranged reads, got %d", storage.ranges)
+	}
+
+	// across blocks
+	p = make([]byte, rangeBlock+10)
+	if n, err := reader.ReadAt(p, rangeBlock/2); err != nil || !bytes.Equal(p[:n], content[rangeBlock/2:rangeBlock/2+n]) {
+		t.Errorf("read across blocks failed: %d %v", n, err)
+	}
+
+	if n, err := reader.ReadAt(p, int64(len(content))-5); n != 5 || err != io.EOF {
+		t.Errorf("expected 5 bytes and EOF at the end, got %d %v", n, err)
+	}
+}
@@ -1,23 +1,43 @@
 package services
 
 import (
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/yewno/acquisition/config"
 )
 
 func NewCobaltS3(cfg *config.Config) (CobaltStorage, error) {
 
+	switch cfg.Encryption {
+	case "", s3.ServerSideEncryptionAes256:
+	case s3.ServerSideEncryptionAwsKms:
+		if cfg.KMSKeyID == "" {
+			return nil, fmt.Errorf("s3: %s encryption needs a KMS key id", cfg.Encryption)
+		}
+	default:
+		return nil, fmt.Errorf("s3: unknown encryption %q", cfg.Encryption)
+	}
+
 	var conn *s3.S3
 	if cfg.Key == "" && cfg.Secret == "" {
 		conn = s3.New(session.New(&aws.Config{
@@ -31,22 +51,99 @@ func NewCobaltS3(cfg *config.Config) (CobaltStorage, error) {
 	}
 
 	return &CobaltS3{
-		Conn: conn,
+		Conn:     conn,
+		uploader: s3manager.NewUploaderWithClient(conn),
+
+		encryption:   cfg.Encryption,
+		kmsKeyID:     cfg.KMSKeyID,
+		storageClass: cfg.StorageClass,
 	}, nil
 }
 
 type CobaltS3 struct {
-	Conn *s3.S3
+	Conn     *s3.S3
+	uploader *s3manager.Uploader
+
+	encryption   string
+	kmsKeyID     string
+	storageClass map[string]string
 }
 
-func (c *CobaltS3) Get(object *Object) error {
+// headers are what every upload of an object is sent with besides its
+// metadata, nil where there is nothing to send.
+type headers struct {
+	contentType     *string
+	contentEncoding *string
+	encryption      *string
+	kmsKeyID        *string
+	storageClass    *string
+	tagging         *string
+}
+
+func (c *CobaltS3) headers(object *Object) *headers {
+
+	h := &headers{
+		contentType:     optional(object.ContentType),
+		contentEncoding: optional(object.ContentEncoding),
+		encryption:      optional(c.encryption),
+	}
+	if c.encryption == s3.ServerSideEncryptionAwsKms {
+		h.kmsKeyID = optional(c.kmsKeyID)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(object.ContentType)
+	h.storageClass = optional(c.storageClass[mediaType])
+
+	if len(object.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range object.Tags {
+			tags.Set(tagText(k, maxTagKey), tagText(v, maxTagValue))
+		}
+		h.tagging = aws.String(tags.Encode())
+	}
+	return h
+}
+
+// maxTagKey and maxTagValue are the lengths S3 allows object tags, in
+// characters.
+const (
+	maxTagKey   = 128
+	maxTagValue = 256
+)
+
+// tagText makes s a valid tag key or value, S3 refuses the whole upload
+// otherwise. Characters S3 doesn't allow are replaced by _ and what is
+// over max is cut off.
+func tagText(s string, max int) string {
+
+	runes := make([]rune, 0, len(s))
+	for _, r := range s {
+		if len(runes) == max {
+			break
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" +-=._:/@", r) {
+			r = '_'
+		}
+		runes = append(runes, r)
+	}
+	return string(runes)
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+func (c *CobaltS3) Get(ctx context.Context, object *Object) error {
 
 	params := s3.GetObjectInput{
 		Bucket: aws.String(object.Bucket),
 		Key:    aws.String(object.Key),
 	}
 
-	resp, err := c.Conn.GetObject(&params)
+	resp, err := c.Conn.GetObjectWithContext(ctx, &params)
 	if err != nil {
 		return err
 	}
@@ -70,26 +167,181 @@ func (c *CobaltS3) Get(object *Object) error {
 	return err
 }
 
-func (c *CobaltS3) Put(object *Object) error {
+func (c *CobaltS3) GetRange(ctx context.Context, object *Object, offset, length int64) (io.ReadCloser, error) {
+
+	params := s3.GetObjectInput{
+		Bucket: aws.String(object.Bucket),
+		Key:    aws.String(object.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+
+	resp, err := c.Conn.GetObjectWithContext(ctx, &params)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *CobaltS3) Put(ctx context.Context, object *Object) error {
 
 	params := s3.PutObjectInput{
 		Bucket: aws.String(object.Bucket),
 		Key:    aws.String(object.Key),
 		Body:   object.File,
 	}
+	if len(object.Metadata) > 0 {
+		params.Metadata = aws.StringMap(object.Metadata)
+	}
+	h := c.headers(object)
+	params.ContentType = h.contentType
+	params.ContentEncoding = h.contentEncoding
+	params.ServerSideEncryption = h.encryption
+	params.SSEKMSKeyId = h.kmsKeyID
+	params.StorageClass = h.storageClass
+	params.Tagging = h.tagging
+
+	_, err := c.Conn.PutObjectWithContext(ctx, &params)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *CobaltS3) Upload(ctx context.Context, object *Object, body io.Reader) error {
+
+	params := s3manager.UploadInput{
+		Bucket: aws.String(object.Bucket),
+		Key:    aws.String(object.Key),
+		Body:   body,
+	}
+	if len(object.Metadata) > 0 {
+		params.Metadata = aws.StringMap(object.Metadata)
+	}
+	h := c.headers(object)
+	params.ContentType = h.contentType
+	params.ContentEncoding = h.contentEncoding
+	params.ServerSideEncryption = h.encryption
+	params.SSEKMSKeyId = h.kmsKeyID
+	params.StorageClass = h.storageClass
+	params.Tagging = h.tagging
+
+	_, err := c.uploader.UploadWithContext(ctx, &params)
+	return err
+}
+
+// SetMetadata copies the object onto itself with the new metadata. The
+// content headers, encryption and storage class aren't kept by a copy, so
+// they are sent again. Tags are.
+func (c *CobaltS3) SetMetadata(ctx context.Context, object *Object) error {
+
+	source := &url.URL{Path: path.Join(object.Bucket, object.Key)}
+	params := s3.CopyObjectInput{
+		Bucket:            aws.String(object.Bucket),
+		Key:               aws.String(object.Key),
+		CopySource:        aws.String(source.EscapedPath()),
+		Metadata:          aws.StringMap(object.Metadata),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	}
+	h := c.headers(object)
+	params.ContentType = h.contentType
+	params.ContentEncoding = h.contentEncoding
+	params.ServerSideEncryption = h.encryption
+	params.SSEKMSKeyId = h.kmsKeyID
+	params.StorageClass = h.storageClass
+
+	_, err := c.Conn.CopyObjectWithContext(ctx, &params)
+	return err
+}
 
-	_, err := c.Conn.PutObject(&params)
+func (c *CobaltS3) Head(ctx context.Context, object *Object) error {
+
+	params := s3.HeadObjectInput{
+		Bucket: aws.String(object.Bucket),
+		Key:    aws.String(object.Key),
+	}
+
+	resp, err := c.Conn.HeadObjectWithContext(ctx, &params)
 	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+			return ErrNotExist
+		}
 		return err
 	}
+
+	object.Size = aws.Int64Value(resp.ContentLength)
+	object.Metadata = aws.StringValueMap(resp.Metadata)
+	object.ContentType = aws.StringValue(resp.ContentType)
+	object.ContentEncoding = aws.StringValue(resp.ContentEncoding)
+	object.Modified = aws.TimeValue(resp.LastModified)
+	object.ETag = strings.Trim(aws.StringValue(resp.ETag), `"`)
 	return nil
 }
 
+func (c *CobaltS3) List(ctx context.Context, bucket, prefix string) ([]*Object, error) {
+
+	params := s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	objects := make([]*Object, 0, 100)
+	err := c.Conn.ListObjectsV2PagesWithContext(ctx, &params, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			object := NewObject(nil, bucket, aws.StringValue(o.Key), aws.Int64Value(o.Size))
+			object.Modified = aws.TimeValue(o.LastModified)
+			objects = append(objects, object)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// MetaSHA256 is the metadata key holding the hex SHA-256 of an object's
+// content before compression. S3 hands metadata keys back capitalized.
+const MetaSHA256 = "Sha256"
+
+// MetaOriginalSize is the metadata key holding the size of an object's
+// content before compression.
+const MetaOriginalSize = "Original-Size"
+
+// Tags processors store objects with.
+const (
+	TagPublisher = "publisher"
+	// TagArchive is the key of the delivery the object came from.
+	TagArchive = "archive"
+	// TagClass is content, meta, other or manifest.
+	TagClass = "class"
+)
+
 type Object struct {
 	File   *os.File
 	Bucket string
 	Key    string
 	Size   int64
+
+	// Hash is the hex SHA-256 of the content, set by Save.
+	Hash     string
+	Metadata map[string]string
+	// Unchanged is set by Save when storage already held the same
+	// content and the upload was skipped. SaveStream also sets it for
+	// streams it had to upload to find out.
+	Unchanged bool
+
+	// Compression decides the codec the object is stored with, nil is
+	// DefaultCompression.
+	Compression Compression
+	// ContentType and ContentEncoding are set by Save.
+	ContentType     string
+	ContentEncoding string
+	// Tags are stored with the object as S3 object tags.
+	Tags map[string]string
+	// Modified is when the object was last stored, set by Head and List.
+	Modified time.Time
+	// ETag is storage's checksum of the object as stored, set by Head.
+	ETag string
 }
 
 func NewObject(file *os.File, bucket, key string, size int64) *Object {
@@ -101,23 +353,104 @@ func NewObject(file *os.File, bucket, key string, size int64) *Object {
 	}
 }
 
-func (o *Object) Save(conn CobaltStorage) error {
+// Save uploads the object unless storage already holds the same content
+// under its key, in which case Unchanged is set.
+func (o *Object) Save(ctx context.Context, conn CobaltStorage) error {
 	var err error
 
-	switch path.Ext(o.Key) {
-	case ".xml":
-		err = o.compress()
+	if err = o.Sum(); err != nil {
+		return err
+	}
+
+	head := make([]byte, 512)
+	n, err := o.File.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if codec := o.encode(head[:n]); codec != CodecNone {
+		if err = o.compress(codec); err != nil {
+			return err
+		}
 	}
 
+	existing, err := o.storedHash(ctx, conn)
 	if err != nil {
 		return err
 	}
+	if existing == o.Hash {
+		o.Unchanged = true
+		log.Printf("Unchanged: %s > %s", o.Key, o.Bucket)
+		return nil
+	}
+	o.setMetadata()
 
 	log.Printf("Uploading: %s > %s", o.Key, o.Bucket)
-	return conn.Put(o)
+	return conn.Put(ctx, o)
+}
+
+// storedHash returns the hash of the object stored under the key, empty
+// when there is none or it can't be told.
+func (o *Object) storedHash(ctx context.Context, conn CobaltStorage) (string, error) {
+
+	existing := NewObject(nil, o.Bucket, o.Key, 0)
+	err := conn.Head(ctx, existing)
+	switch {
+	case err == nil:
+		return existing.Metadata[MetaSHA256], nil
+	case ctx.Err() != nil:
+		return "", ctx.Err()
+	case err != ErrNotExist:
+		log.Println(err)
+	}
+	return "", nil
+}
+
+// encode decides how the object is stored from its key and the head of
+// its content: the codec it is compressed with, whose extension is
+// appended to the key, and its content headers.
+func (o *Object) encode(head []byte) string {
+
+	codec := o.Compression.Codec(o.Key)
+	o.ContentType = contentType(o.Key, head)
+	if codec != CodecNone {
+		o.ContentEncoding = codec
+		o.Key += codecExt[codec]
+	}
+	return codec
+}
+
+func (o *Object) setMetadata() {
+	if o.Metadata == nil {
+		o.Metadata = make(map[string]string, 2)
+	}
+	o.Metadata[MetaSHA256] = o.Hash
+	o.Metadata[MetaOriginalSize] = strconv.FormatInt(o.Size, 10)
+}
+
+// Sum sets Hash and Size from the content of File and rewinds it.
+func (o *Object) Sum() error {
+
+	if _, err := o.File.Seek(0, 0); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, o.File)
+	if err != nil {
+		return err
+	}
+	o.Hash = hex.EncodeToString(h.Sum(nil))
+	o.Size = size
+
+	_, err = o.File.Seek(0, 0)
+	return err
 }
 
 func (o *Object) Close() error {
+	if o.File == nil {
+		return nil
+	}
 	err := o.File.Close()
 	if err != nil {
 		log.Println(err)
@@ -130,14 +463,18 @@ func (o *Object) Close() error {
 	return err
 }
 
-func (o *Object) compress() error {
+// compress replaces File with its content compressed with the codec.
+func (o *Object) compress(codec string) error {
 
 	temp, err := ioutil.TempFile("", "")
 	if err != nil {
 		return err
 	}
 
-	writer := gzip.NewWriter(temp)
+	writer, err := compressor(codec, temp)
+	if err != nil {
+		return err
+	}
 
 	_, err = io.Copy(writer, o.File)
 	if err != nil {
@@ -145,7 +482,6 @@ func (o *Object) compress() error {
 	}
 
 	o.File = temp
-	o.Key = fmt.Sprintf("%s.gz", o.Key)
 
 	if err = writer.Close(); err != nil {
 		return err
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/yewno/acquisition/config"
+)
+
+func TestHeaders(t *testing.T) {
+
+	c := &CobaltS3{
+		encryption:   "aws:kms",
+		kmsKeyID:     "key",
+		storageClass: map[string]string{"application/pdf": "STANDARD_IA"},
+	}
+
+	object := NewObject(nil, "processed", "bmj/1.pdf", 0)
+	object.ContentType = "application/pdf"
+	object.Tags = map[string]string{TagPublisher: "bmj", TagArchive: "files/bmj/1 2.zip", TagClass: "content"}
+
+	h := c.headers(object)
+	if aws.StringValue(h.encryption) != "aws:kms" || aws.StringValue(h.kmsKeyID) != "key" {
+		t.Errorf("unexpected encryption %v %v", aws.StringValue(h.encryption), aws.StringValue(h.kmsKeyID))
+	}
+	if aws.StringValue(h.storageClass) != "STANDARD_IA" {
+		t.Errorf("unexpected storage class %v", aws.StringValue(h.storageClass))
+	}
+	if got := aws.StringValue(h.tagging); got != "archive=files%2Fbmj%2F1+2.zip&class=content&publisher=bmj" {
+		t.Errorf("unexpected tagging %s", got)
+	}
+	if h.contentEncoding != nil {
+		t.Errorf("unexpected content encoding %v", aws.StringValue(h.contentEncoding))
+	}
+
+	// S3 refuses tags over 256 characters or with characters it doesn't
+	// allow, and with them the upload
+	object.Tags = map[string]string{TagArchive: "files/bmj/" + strings.Repeat("é", 300) + "[1]#.zip"}
+	h = c.headers(object)
+	values, _ := url.ParseQuery(aws.StringValue(h.tagging))
+	if archive := values.Get(TagArchive); utf8.RuneCountInString(archive) != maxTagValue || !strings.HasPrefix(archive, "files/bmj/é") {
+		t.Errorf("unexpected archive tag %s", archive)
+	}
+	if got := tagText("files/bmj/[1]#.zip", maxTagValue); got != "files/bmj/_1__.zip" {
+		t.Errorf("unexpected tag %s", got)
+	}
+
+	object.ContentType = "text/xml; charset=utf-8"
+	object.Tags = nil
+	h = c.headers(object)
+	if h.storageClass != nil || h.tagging != nil {
+		t.Errorf("expected the default storage class and no tags, got %v %v", h.storageClass, h.tagging)
+	}
+}
+
+func TestEncryptionConfig(t *testing.T) {
+
+	for _, cfg := range []*config.Config{
+		{Encryption: "aws:kms"},
+		{Encryption: "DES"},
+	} {
+		if _, err := NewCobaltS3(cfg); err == nil {
+			t.Errorf("expected %q encryption to fail", cfg.Encryption)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"path"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/satori/go.uuid"
@@ -19,6 +25,23 @@ type Message struct {
 	QueueUrl string `json:"-"`
 	Receipt  string `json:"-"`
 	Body     string `json:"body"`
+
+	// ID stays the same for every delivery of the message.
+	ID string `json:"-"`
+	// Attempts is how many times the message has been received, this
+	// time included.
+	Attempts int `json:"-"`
+}
+
+// DeadLetter is sent to the dead letter queue for a message that failed too
+// many times.
+type DeadLetter struct {
+	// Body is the original body of the message.
+	Body      string   `json:"body"`
+	Publisher string   `json:"publisher,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	Attempts  int      `json:"attempts"`
+	Errors    []string `json:"errors"`
 }
 
 type PairMessage struct {
@@ -26,26 +49,57 @@ type PairMessage struct {
 	Bucket  string `json:"bucket"`
 	Key     string `json:"key"`
 	MetaKey string `json:"metakey,omitempty"`
+	// Attachments are the keys of images and supplementary files that
+	// belong to the article.
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// ClaimCheckMessage is sent in place of a message too large for SQS. The
+// message itself is stored in the processed bucket.
+type ClaimCheckMessage struct {
+	ClaimCheck *ClaimCheck `json:"claimcheck"`
 }
 
+type ClaimCheck struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+}
+
+// DefaultClaimCheckPrefix is where claim checked messages go when the
+// config doesn't say.
+const DefaultClaimCheckPrefix = "claim-checks"
+
 type SnsMessage struct {
-	Records []struct {
-		S3 struct {
-			Object struct {
-				Key  string `json:"key"`
-				Size int64  `json:"size"`
-			} `json:"object"`
-			Bucket struct {
-				Name string `json:"name"`
-			} `json:"bucket"`
-		} `json:"s3"`
-	} `json:"Records"`
+	Records []SnsRecord `json:"Records"`
+	// Direct is set on the events backfills enqueue, they aren't S3's
+	// and no other event completes their delivery.
+	Direct bool `json:"direct,omitempty"`
+}
+
+// SnsRecord is the S3 event of a single object.
+type SnsRecord struct {
+	S3 struct {
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"object"`
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+	} `json:"s3"`
 }
 
 // CobalsSqs is a struct that handles communication for SQS
 type CobaltSqs struct {
 	Conn      *sqs.SQS
 	queueURLs map[string]string
+
+	// claims stores messages too large to send under claimPrefix in
+	// claimBucket.
+	claims      CobaltStorage
+	claimBucket string
+	claimPrefix string
 }
 
 // NewCobaltSqs will return a queue connection. If key and secret are empty strings then they
@@ -77,15 +131,29 @@ func NewCobaltSqs(cfg *config.Config, queues ...string) (CobaltQueue, error) {
 
 	}
 
+	claims, err := NewStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := cfg.ClaimCheckPrefix
+	if prefix == "" {
+		prefix = DefaultClaimCheckPrefix
+	}
+
 	return &CobaltSqs{
-		Conn:      conn,
-		queueURLs: queueURLs,
+		Conn:        conn,
+		queueURLs:   queueURLs,
+		claims:      claims,
+		claimBucket: cfg.ProcessedBucket,
+		claimPrefix: prefix,
 	}, nil
 }
 
 // Poll receives messages from the queue and populates the channel. Poll will continue
-// to check the queue for messages returning nil when no messages were found.
-func (c *CobaltSqs) Poll(queue string, max int) chan *Message {
+// to check the queue for messages returning nil when no messages were found, until
+// the context is done.
+func (c *CobaltSqs) Poll(ctx context.Context, queue string, max int) chan *Message {
 	response := make(chan *Message, max)
 
 	go func(channel chan *Message) {
@@ -95,24 +163,43 @@ func (c *CobaltSqs) Poll(queue string, max int) chan *Message {
 			QueueUrl:              aws.String(c.queueURLs[queue]),
 			MaxNumberOfMessages:   aws.Int64(int64(max)),
 			MessageAttributeNames: []*string{aws.String("ALL")},
+			AttributeNames:        []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
 			WaitTimeSeconds:       aws.Int64(2),
 		}
 
-		for {
+		for ctx.Err() == nil {
 
-			resp, err := c.Conn.ReceiveMessage(params)
+			resp, err := c.Conn.ReceiveMessageWithContext(ctx, params)
 			if err != nil {
-				log.Println(err)
+				if ctx.Err() == nil {
+					log.Println(err)
+				}
 				continue
 			}
 
 			if len(resp.Messages) == 0 {
-				channel <- nil
+				select {
+				case channel <- nil:
+				case <-ctx.Done():
+				}
 				continue
 			}
 
+			// messages received after the context is done are left to
+			// come back once their visibility timeout runs out
 			for _, m := range resp.Messages {
-				channel <- &Message{Body: *m.Body, Receipt: *m.ReceiptHandle}
+				attempts, _ := strconv.Atoi(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+				message := &Message{
+					Body:     *m.Body,
+					Receipt:  *m.ReceiptHandle,
+					ID:       aws.StringValue(m.MessageId),
+					Attempts: attempts,
+				}
+
+				select {
+				case channel <- message:
+				case <-ctx.Done():
+				}
 			}
 		}
 	}(response)
@@ -120,13 +207,13 @@ func (c *CobaltSqs) Poll(queue string, max int) chan *Message {
 }
 
 // Pop removes a message from the queue
-func (c *CobaltSqs) Pop(queue, receipt string) error {
+func (c *CobaltSqs) Pop(ctx context.Context, queue, receipt string) error {
 
 	params := &sqs.DeleteMessageInput{
 		QueueUrl:      aws.String(c.queueURLs[queue]),
 		ReceiptHandle: aws.String(receipt),
 	}
-	_, err := c.Conn.DeleteMessage(params)
+	_, err := c.Conn.DeleteMessageWithContext(ctx, params)
 
 	if err != nil {
 		return err
@@ -134,18 +221,46 @@ func (c *CobaltSqs) Pop(queue, receipt string) error {
 	return nil
 }
 
+// ExtendVisibility changes the visibility timeout of a received message to
+// timeout from now. SQS allows at most 12 hours.
+func (c *CobaltSqs) ExtendVisibility(ctx context.Context, queue, receipt string, timeout time.Duration) error {
+
+	params := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(c.queueURLs[queue]),
+		ReceiptHandle:     aws.String(receipt),
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	}
+	_, err := c.Conn.ChangeMessageVisibilityWithContext(ctx, params)
+	return err
+}
+
 // NewBatch returns a batch struct that will bundle sqs messages and send them up
-// onces the buffer is full (10 messages) or if the last message received was more than
-// 10 seconds ago.
-func (c *CobaltSqs) NewBatch(queue string) CobaltQueueBatch {
-	return NewCobaltSqsBatch(c.Conn, c.queueURLs[queue])
+// onces the buffer is full (10 messages or 256 KB) or if the last message received was
+// more than 10 seconds ago. Messages over 256 KB are stored in the processed bucket and
+// a ClaimCheckMessage is sent instead.
+func (c *CobaltSqs) NewBatch(ctx context.Context, queue string) CobaltQueueBatch {
+	batch := newCobaltSqsBatch(ctx, c.Conn, c.queueURLs[queue])
+	batch.claims = c.claims
+	batch.claimBucket = c.claimBucket
+	batch.claimPrefix = c.claimPrefix
+	return batch
 }
 
 // NewCobaltSqsBatch creates a new batch struct attached to the queue it was called from.
-func NewCobaltSqsBatch(conn *sqs.SQS, queue string) CobaltQueueBatch {
+func NewCobaltSqsBatch(ctx context.Context, conn *sqs.SQS, queue string) CobaltQueueBatch {
+	return newCobaltSqsBatch(ctx, conn, queue)
+}
+
+// batchSender is the part of the SQS client a batch uses.
+type batchSender interface {
+	SendMessageBatchWithContext(aws.Context, *sqs.SendMessageBatchInput, ...request.Option) (*sqs.SendMessageBatchOutput, error)
+}
+
+func newCobaltSqsBatch(ctx context.Context, conn batchSender, queue string) *CobaltSqsBatch {
 	var wg sync.WaitGroup
 
 	batch := &CobaltSqsBatch{
+		ctx:      ctx,
 		messages: make(chan *sqs.SendMessageBatchRequestEntry, 10),
 		conn:     conn,
 		queue:    queue,
@@ -157,19 +272,52 @@ func NewCobaltSqsBatch(conn *sqs.SQS, queue string) CobaltQueueBatch {
 	return batch
 }
 
+// maxBatchEntries and maxBatchBytes are the limits SQS puts on a single
+// SendMessageBatch, maxBatchBytes is also the limit of a single message.
+const (
+	maxBatchEntries = 10
+	maxBatchBytes   = 256 * 1024
+)
+
+// sendAttempts is how many times an entry is sent before it is given up,
+// sendBackoff how long the first retry waits, doubling for every further one.
+var (
+	sendAttempts = 3
+	sendBackoff  = 500 * time.Millisecond
+)
+
 // CobaltSqsBatch struct that handles the actual batching.
 type CobaltSqsBatch struct {
+	ctx      context.Context
 	messages chan *sqs.SendMessageBatchRequestEntry
-	conn     *sqs.SQS
+	conn     batchSender
 	queue    string
 	wg       *sync.WaitGroup
+
+	claims      CobaltStorage
+	claimBucket string
+	claimPrefix string
+
+	// failed counts the entries given up on and err is the last reason,
+	// both are only touched by process.
+	failed int
+	err    error
+	// rejected counts the messages Add failed to take, for Flush to fail
+	// with addErr.
+	rejected int
+	addErr   error
 }
 
 // Add adds a message to the batch to be send up to the queue
 func (c *CobaltSqsBatch) Add(msg interface{}) error {
 
 	b, err := json.Marshal(msg)
+	if err == nil && len(b) > maxBatchBytes {
+		b, err = c.claimCheck(b)
+	}
 	if err != nil {
+		c.rejected++
+		c.addErr = err
 		return err
 	}
 
@@ -182,47 +330,144 @@ func (c *CobaltSqsBatch) Add(msg interface{}) error {
 	return nil
 }
 
-// Flush sends any remaining messages to the queue.
-func (c *CobaltSqsBatch) Flush() {
+// Flush sends any remaining messages to the queue. It fails when any message
+// of the batch couldn't be sent, retries included.
+func (c *CobaltSqsBatch) Flush() error {
 	close(c.messages)
 	c.wg.Wait()
+
+	if c.failed > 0 {
+		return fmt.Errorf("sqs: %d messages not sent to %s: %v", c.failed+c.rejected, c.queue, c.err)
+	}
+	if c.rejected > 0 {
+		return fmt.Errorf("sqs: %d messages not sent to %s: %v", c.rejected, c.queue, c.addErr)
+	}
+	return nil
 }
 
 func (c *CobaltSqsBatch) process() {
 	defer c.wg.Done()
 
-	params := &sqs.SendMessageBatchInput{QueueUrl: aws.String(c.queue)}
-	batch := make([]*sqs.SendMessageBatchRequestEntry, 0, 10)
+	batch := make([]*sqs.SendMessageBatchRequestEntry, 0, maxBatchEntries)
+	size := 0
 
 	for m := range c.messages {
 
+		n := len(aws.StringValue(m.MessageBody))
+		if size+n > maxBatchBytes {
+			c.send(batch)
+			batch = make([]*sqs.SendMessageBatchRequestEntry, 0, maxBatchEntries)
+			size = 0
+		}
+
 		batch = append(batch, m)
+		size += n
 
-		if len(batch) < 10 {
+		if len(batch) < maxBatchEntries {
 			continue
 		}
 
-		params.Entries = batch
-		batch = c.send(params)
-
+		c.send(batch)
+		batch = make([]*sqs.SendMessageBatchRequestEntry, 0, maxBatchEntries)
+		size = 0
 	}
 
 	if len(batch) > 0 {
-		params.Entries = batch
-		c.send(params)
+		c.send(batch)
 	}
 }
 
-func (c *CobaltSqsBatch) send(params *sqs.SendMessageBatchInput) []*sqs.SendMessageBatchRequestEntry {
-	resp, err := c.conn.SendMessageBatch(params)
+// claimCheck stores a message too large for SQS and returns the
+// ClaimCheckMessage to send in its place.
+func (c *CobaltSqsBatch) claimCheck(body []byte) ([]byte, error) {
+
+	if c.claims == nil {
+		return nil, fmt.Errorf("sqs: message of %d bytes is over the %d byte limit", len(body), maxBatchBytes)
+	}
+
+	file, err := ioutil.TempFile("", "")
 	if err != nil {
-		log.Println(err)
-		return make([]*sqs.SendMessageBatchRequestEntry, 0, 10)
+		return nil, err
+	}
+
+	size, err := file.Write(body)
+	key := path.Join(c.claimPrefix, fmt.Sprintf("%s.json", uuid.NewV4()))
+	object := NewObject(file, c.claimBucket, key, int64(size))
+	defer object.Close()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	if err := c.claims.Put(c.ctx, object); err != nil {
+		return nil, err
+	}
+	log.Printf("Claim check: %d bytes > %s/%s", size, c.claimBucket, key)
+
+	return json.Marshal(&ClaimCheckMessage{
+		ClaimCheck: &ClaimCheck{Bucket: c.claimBucket, Key: key, Size: object.Size},
+	})
+}
+
+// send sends the entries, retrying those that failed through no fault of
+// their own. Entries SQS rejects as malformed aren't retried.
+func (c *CobaltSqsBatch) send(entries []*sqs.SendMessageBatchRequestEntry) {
+
+	for attempt := 1; ; attempt++ {
+
+		params := &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(c.queue),
+			Entries:  entries,
+		}
+
+		resp, err := c.conn.SendMessageBatchWithContext(c.ctx, params)
+		if err != nil {
+			log.Println(err)
+			c.err = err
+		} else {
+			entries = c.retryable(entries, resp.Failed)
+		}
+
+		if len(entries) == 0 {
+			return
+		}
+		if attempt == sendAttempts || c.ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case <-time.After(sendBackoff << uint(attempt-1)):
+		case <-c.ctx.Done():
+		}
+	}
+
+	c.failed += len(entries)
+}
+
+// retryable returns the entries that failed and may succeed when sent again.
+func (c *CobaltSqsBatch) retryable(entries []*sqs.SendMessageBatchRequestEntry, failed []*sqs.BatchResultErrorEntry) []*sqs.SendMessageBatchRequestEntry {
+
+	byID := make(map[string]*sqs.SendMessageBatchRequestEntry, len(entries))
+	for _, entry := range entries {
+		byID[aws.StringValue(entry.Id)] = entry
 	}
-	if len(resp.Failed) > 0 {
-		for _, item := range resp.Failed {
-			log.Printf(fmt.Sprintf("Code: %s, Message: %s", *item.Code, *item.Message))
+
+	retry := make([]*sqs.SendMessageBatchRequestEntry, 0, len(failed))
+	for _, item := range failed {
+		c.err = fmt.Errorf("%s: %s", aws.StringValue(item.Code), aws.StringValue(item.Message))
+		log.Printf("Code: %s, Message: %s", aws.StringValue(item.Code), aws.StringValue(item.Message))
+
+		entry, ok := byID[aws.StringValue(item.Id)]
+		if !ok {
+			continue
+		}
+		if aws.BoolValue(item.SenderFault) {
+			c.failed++
+			continue
 		}
+		retry = append(retry, entry)
 	}
-	return make([]*sqs.SendMessageBatchRequestEntry, 0, 10)
+	return retry
 }
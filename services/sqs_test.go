@@ -1 +1,250 @@
 package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// flakySender fails the first entry of every request until it has failed
+// failures times, and rejects bodies in malformed outright.
+type flakySender struct {
+	mu        sync.Mutex
+	failures  int
+	err       error
+	malformed map[string]bool
+	sent      []string
+	// requests are the sizes in bytes of the requests.
+	requests []int
+}
+
+func (f *flakySender) SendMessageBatchWithContext(ctx aws.Context, in *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	size := 0
+	for _, entry := range in.Entries {
+		size += len(aws.StringValue(entry.MessageBody))
+	}
+	f.requests = append(f.requests, size)
+
+	out := &sqs.SendMessageBatchOutput{}
+	for i, entry := range in.Entries {
+		body := aws.StringValue(entry.MessageBody)
+		switch {
+		case f.malformed[body]:
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id: entry.Id, Code: aws.String("InvalidMessageContents"), Message: aws.String("malformed"), SenderFault: aws.Bool(true),
+			})
+		case i == 0 && f.failures > 0:
+			f.failures--
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id: entry.Id, Code: aws.String("InternalError"), Message: aws.String("try again"), SenderFault: aws.Bool(false),
+			})
+		default:
+			f.sent = append(f.sent, body)
+		}
+	}
+	return out, nil
+}
+
+// memStorage keeps what is put in memory.
+type memStorage struct {
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+	// headers are the content type and encoding of every object.
+	headers map[string][2]string
+	uploads int
+	ranges  int
+	// copies counts SetMetadata, which copies the object onto itself.
+	copies int
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		objects:  make(map[string][]byte),
+		metadata: make(map[string]map[string]string),
+		headers:  make(map[string][2]string),
+	}
+}
+
+func (m *memStorage) Get(ctx context.Context, o *Object) error { return ErrNotExist }
+
+func (m *memStorage) GetRange(ctx context.Context, o *Object, offset, length int64) (io.ReadCloser, error) {
+	b, ok := m.objects[o.Bucket+"/"+o.Key]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	m.ranges++
+	return ioutil.NopCloser(bytes.NewReader(b[offset : offset+length])), nil
+}
+
+func (m *memStorage) Head(ctx context.Context, o *Object) error {
+	b, ok := m.objects[o.Bucket+"/"+o.Key]
+	if !ok {
+		return ErrNotExist
+	}
+	o.Size = int64(len(b))
+	o.Metadata = m.metadata[o.Bucket+"/"+o.Key]
+	return nil
+}
+
+func (m *memStorage) Put(ctx context.Context, o *Object) error {
+	return m.Upload(ctx, o, o.File)
+}
+
+func (m *memStorage) Upload(ctx context.Context, o *Object, body io.Reader) error {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.uploads++
+	m.objects[o.Bucket+"/"+o.Key] = b
+	m.setMetadata(o)
+	return nil
+}
+
+func (m *memStorage) List(ctx context.Context, bucket, prefix string) ([]*Object, error) {
+	objects := make([]*Object, 0, len(m.objects))
+	for key, b := range m.objects {
+		if strings.HasPrefix(key, bucket+"/"+prefix) {
+			objects = append(objects, NewObject(nil, bucket, strings.TrimPrefix(key, bucket+"/"), int64(len(b))))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (m *memStorage) SetMetadata(ctx context.Context, o *Object) error {
+	m.copies++
+	m.setMetadata(o)
+	return nil
+}
+
+func (m *memStorage) setMetadata(o *Object) {
+	metadata := make(map[string]string, len(o.Metadata))
+	for k, v := range o.Metadata {
+		metadata[k] = v
+	}
+	m.metadata[o.Bucket+"/"+o.Key] = metadata
+	m.headers[o.Bucket+"/"+o.Key] = [2]string{o.ContentType, o.ContentEncoding}
+}
+
+func sendAll(t *testing.T, sender *flakySender, bodies ...string) error {
+	return sendTo(t, newCobaltSqsBatch(context.Background(), sender, "queue"), bodies...)
+}
+
+func sendTo(t *testing.T, batch *CobaltSqsBatch, bodies ...string) error {
+
+	sendBackoff = time.Millisecond
+	for _, body := range bodies {
+		if err := batch.Add(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return batch.Flush()
+}
+
+func TestBatchRetry(t *testing.T) {
+
+	sender := &flakySender{failures: 2}
+	if err := sendAll(t, sender, "a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 3 {
+		t.Errorf("expected 3 messages sent, got %v", sender.sent)
+	}
+}
+
+func TestBatchFailed(t *testing.T) {
+
+	sender := &flakySender{failures: sendAttempts, malformed: map[string]bool{`"b"`: true}}
+	err := sendAll(t, sender, "a", "b", "c")
+	if err == nil {
+		t.Fatal("expected Flush to report the messages not sent")
+	}
+	if len(sender.sent) != 1 {
+		t.Errorf("expected only c sent, got %v", sender.sent)
+	}
+
+	sender = &flakySender{err: errors.New("connection reset")}
+	if err := sendAll(t, sender, "a"); err == nil {
+		t.Fatal("expected Flush to report the messages not sent")
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+
+	sender := &flakySender{}
+	large := strings.Repeat("a", 100*1024)
+	if err := sendAll(t, sender, large, large, large, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %v", sender.requests)
+	}
+	for _, size := range sender.requests {
+		if size > maxBatchBytes {
+			t.Errorf("request of %d bytes", size)
+		}
+	}
+}
+
+func TestBatchClaimCheck(t *testing.T) {
+
+	sender := &flakySender{}
+	storage := newMemStorage()
+
+	batch := newCobaltSqsBatch(context.Background(), sender, "queue")
+	batch.claims = storage
+	batch.claimBucket = "processed"
+	batch.claimPrefix = DefaultClaimCheckPrefix
+
+	huge := strings.Repeat("a", maxBatchBytes)
+	if err := sendTo(t, batch, huge, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.sent) != 2 {
+		t.Fatalf("expected 2 messages sent, got %d", len(sender.sent))
+	}
+	m := &ClaimCheckMessage{}
+	if err := json.Unmarshal([]byte(sender.sent[0]), m); err != nil || m.ClaimCheck == nil {
+		t.Fatalf("expected a claim check, got %.100s", sender.sent[0])
+	}
+
+	stored := storage.objects[m.ClaimCheck.Bucket+"/"+m.ClaimCheck.Key]
+	var body string
+	if err := json.Unmarshal(stored, &body); err != nil || body != huge {
+		t.Errorf("stored message doesn't match, %d bytes", len(stored))
+	}
+	if !strings.HasPrefix(m.ClaimCheck.Key, DefaultClaimCheckPrefix+"/") || m.ClaimCheck.Size != int64(len(stored)) {
+		t.Errorf("unexpected claim check %+v", m.ClaimCheck)
+	}
+
+	// without storage the message can't be sent at all
+	batch = newCobaltSqsBatch(context.Background(), &flakySender{}, "queue")
+	if err := batch.Add(huge); err == nil {
+		t.Error("expected an error for a message over the limit")
+	}
+	if err := batch.Flush(); err == nil {
+		t.Error("expected Flush to report the message not sent")
+	}
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+)
+
+// streamBuffer is how much of a stream SaveStream holds in memory. Content
+// that fits is hashed and uploaded from memory, and skipped when unchanged
+// like with Save. So is larger content that can be read twice in place.
+const streamBuffer = 5 * 1024 * 1024
+
+// SaveStream uploads what is read from r like Save does a file. A seekable
+// r is hashed in place first, from where it is. Any other r too large for
+// memory is hashed on its way up, it is uploaded even when unchanged and
+// its metadata is set once the upload is done. Size is set to the bytes
+// read.
+func (o *Object) SaveStream(ctx context.Context, conn CobaltStorage, r io.Reader) error {
+
+	var (
+		seeker io.ReadSeeker
+		start  int64
+	)
+	if s, ok := r.(io.ReadSeeker); ok {
+		offset, err := s.Seek(0, io.SeekCurrent)
+		if err == nil {
+			seeker, start = s, offset
+		}
+	}
+
+	head, more, err := ReadHead(r, streamBuffer)
+	if err != nil {
+		return err
+	}
+	if !more {
+		return o.saveBytes(ctx, conn, head)
+	}
+
+	if seeker == nil {
+		return o.streamUpload(ctx, conn, head, r)
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return err
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	o.Size = size
+	o.Hash = hex.EncodeToString(h.Sum(nil))
+	codec := o.encode(head)
+
+	existing, err := o.storedHash(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if existing == o.Hash {
+		o.Unchanged = true
+		log.Printf("Unchanged: %s > %s", o.Key, o.Bucket)
+		return nil
+	}
+	o.setMetadata()
+
+	var upload io.Reader = seeker
+	if codec != CodecNone {
+		compressed := compressReader(codec, seeker)
+		defer compressed.Close()
+		upload = compressed
+	}
+
+	log.Printf("Streaming: %s > %s", o.Key, o.Bucket)
+	return conn.Upload(ctx, o, upload)
+}
+
+// streamUpload uploads content that can only be read once, hashing and
+// counting it on the way. The object is stored without its hash until
+// SetMetadata adds it, so an upload cut short in between is redone.
+// Unchanged is set when the content turns out to be what was stored.
+func (o *Object) streamUpload(ctx context.Context, conn CobaltStorage, head []byte, r io.Reader) error {
+
+	codec := o.encode(head)
+	existing, err := o.storedHash(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	var size countWriter
+	var upload io.Reader = io.TeeReader(io.MultiReader(bytes.NewReader(head), r), io.MultiWriter(h, &size))
+	if codec != CodecNone {
+		compressed := compressReader(codec, upload)
+		defer compressed.Close()
+		upload = compressed
+	}
+
+	log.Printf("Streaming: %s > %s", o.Key, o.Bucket)
+	if err := conn.Upload(ctx, o, upload); err != nil {
+		return err
+	}
+
+	o.Size = int64(size)
+	o.Hash = hex.EncodeToString(h.Sum(nil))
+	o.Unchanged = existing == o.Hash
+	o.setMetadata()
+	return conn.SetMetadata(ctx, o)
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+// ReadHead reads r up to limit bytes, into a buffer that grows as it is
+// filled, and reports whether r may hold more.
+func ReadHead(r io.Reader, limit int) ([]byte, bool, error) {
+
+	buf := make([]byte, 0, 512)
+	for {
+		if len(buf) == cap(buf) {
+			if len(buf) >= limit {
+				return buf, true, nil
+			}
+			size := 2 * cap(buf)
+			if size > limit {
+				size = limit
+			}
+			grown := make([]byte, len(buf), size)
+			copy(grown, buf)
+			buf = grown
+		}
+
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// saveBytes saves content small enough to be held in memory.
+func (o *Object) saveBytes(ctx context.Context, conn CobaltStorage, content []byte) error {
+
+	sum := sha256.Sum256(content)
+	o.Hash = hex.EncodeToString(sum[:])
+	o.Size = int64(len(content))
+
+	body := content
+	if codec := o.encode(content); codec != CodecNone {
+		var buf bytes.Buffer
+		writer, err := compressor(codec, &buf)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(content); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	existing, err := o.storedHash(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if existing == o.Hash {
+		o.Unchanged = true
+		log.Printf("Unchanged: %s > %s", o.Key, o.Bucket)
+		return nil
+	}
+	o.setMetadata()
+
+	log.Printf("Uploading: %s > %s", o.Key, o.Bucket)
+	return conn.Upload(ctx, o, bytes.NewReader(body))
+}
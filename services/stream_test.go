@@ -0,0 +1,79 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestSaveStream(t *testing.T) {
+
+	storage := newMemStorage()
+
+	for _, size := range []int{100, 3 * streamBuffer / 2} {
+
+		content := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(content)
+		sum := sha256.Sum256(content)
+
+		// saved again from a seekable reader and from a plain stream
+		for i, unchanged := range []bool{false, true, true} {
+			var r io.Reader = bytes.NewReader(content)
+			if i == 2 {
+				r = io.MultiReader(r)
+			}
+			object := NewObject(nil, "processed", "a.xml", 0)
+			if err := object.SaveStream(context.Background(), storage, r); err != nil {
+				t.Fatal(err)
+			}
+
+			if object.Key != "a.xml.gz" || object.Size != int64(size) || object.Hash != hex.EncodeToString(sum[:]) {
+				t.Errorf("%d bytes: unexpected object %+v", size, object)
+			}
+			if object.Unchanged != unchanged {
+				t.Errorf("%d bytes, save %d: expected unchanged %v", size, i+1, unchanged)
+			}
+			if storage.metadata["processed/a.xml.gz"][MetaSHA256] != object.Hash {
+				t.Errorf("%d bytes: hash not in metadata %v", size, storage.metadata["processed/a.xml.gz"])
+			}
+
+			reader, err := gzip.NewReader(bytes.NewReader(storage.objects["processed/a.xml.gz"]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := ioutil.ReadAll(reader)
+			if err != nil || !bytes.Equal(stored, content) {
+				t.Errorf("%d bytes: stored content differs", size)
+			}
+		}
+	}
+
+	// unchanged content is skipped, unless it is too large for memory
+	// and can't be read twice: it is uploaded and its hash set after
+	if storage.uploads != 3 || storage.copies != 1 {
+		t.Errorf("expected 3 uploads and 1 copy, got %d and %d", storage.uploads, storage.copies)
+	}
+}
+
+func TestReadHead(t *testing.T) {
+
+	for _, size := range []int{0, 100, 1000, 1024} {
+		content := bytes.Repeat([]byte("a"), size)
+		head, more, err := ReadHead(io.MultiReader(bytes.NewReader(content)), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if more != (size >= 1000) {
+			t.Errorf("%d bytes: more is %v", size, more)
+		}
+		if len(head) != size && len(head) != 1000 || cap(head) > 1000 {
+			t.Errorf("%d bytes: read %d into %d", size, len(head), cap(head))
+		}
+	}
+}